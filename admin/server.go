@@ -0,0 +1,384 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backend is the running simulation the admin API operates on
+type Backend interface {
+	Router() sandbox.Router
+	// Actors returns the current instance of every actor
+	Actors() []sandbox.Actor
+	Kill(actorID string) error
+	// Restart starts the new instance of the killed actor
+	Restart(actorID string) error
+}
+
+// ErrNotFound is returned by Backend for unknown actors,
+// the API responds with 404 to them
+type ErrNotFound struct {
+	ActorID string
+}
+
+func (e *ErrNotFound) Error() string {
+	return fmt.Sprintf("unknown actor '%s'", e.ActorID)
+}
+
+// resubscribeInterval is how often the event stream looks for restarted actors
+const resubscribeInterval = 500 * time.Millisecond
+
+// Event is sent to the event stream for every ConnectionEvent
+type Event struct {
+	Actor       string                    `json:"actor"`
+	Type        string                    `json:"type"`
+	Connections []sandbox.ConnectionState `json:"connections"`
+}
+
+type handler struct {
+	backend Backend
+	mux     *http.ServeMux
+}
+
+// NewHandler returns the admin API and the page visualising it:
+//
+//	GET  /                                            web UI
+//	GET  /api/router                                  sandbox.RouterState
+//	GET  /api/actors                                  sandbox.ClusterState
+//	GET  /api/actors/<id>                             sandbox.ActorState
+//	GET  /api/actors/<id>/connections/<conn>          sandbox.ConnectionState
+//	GET  /api/events[?actor=<id>]                     server-sent Events
+//	POST /api/actors/<id>/kill|restart
+//	POST /api/nodes/<node>/kill|freeze|unfreeze|partition|reconnect
+//
+// POST requests must have the JSON Content-Type and come from the same
+// origin, so other pages opened in the browser can't inject faults
+func NewHandler(backend Backend) http.Handler {
+	rv := &handler{
+		backend: backend,
+		mux:     http.NewServeMux(),
+	}
+	rv.mux.HandleFunc("/", rv.index)
+	rv.mux.HandleFunc("/api/router", rv.router)
+	rv.mux.HandleFunc("/api/actors", rv.actors)
+	rv.mux.HandleFunc("/api/actors/", rv.actor)
+	rv.mux.HandleFunc("/api/nodes/", rv.node)
+	rv.mux.HandleFunc("/api/events", rv.events)
+	return rv
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) router(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.backend.Router().State())
+}
+
+func (h *handler) actors(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, sandbox.Snapshot(h.backend.Actors()...))
+}
+
+// actor serves /api/actors/<id>[/connections/<conn>|/kill|/restart]
+func (h *handler) actor(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/actors/"), "/")
+	id := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		a, ok := h.find(id)
+		if !ok {
+			writeError(w, &ErrNotFound{ActorID: id})
+			return
+		}
+		writeJSON(w, http.StatusOK, a.State())
+	case len(parts) == 3 && parts[1] == "connections":
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		a, ok := h.find(id)
+		if !ok {
+			writeError(w, &ErrNotFound{ActorID: id})
+			return
+		}
+		conn, ok := a.State().Connection(parts[2])
+		if !ok {
+			writeJSON(w, http.StatusNotFound, errorBody(fmt.Sprintf("no connection '%s' on '%s'", parts[2], id)))
+			return
+		}
+		writeJSON(w, http.StatusOK, conn)
+	case len(parts) == 2 && parts[1] == "kill":
+		if allowChange(w, r) {
+			h.do(w, id, h.backend.Kill)
+		}
+	case len(parts) == 2 && parts[1] == "restart":
+		if allowChange(w, r) {
+			h.do(w, id, h.backend.Restart)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// node serves /api/nodes/<node>/<fault>
+func (h *handler) node(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/nodes/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowChange(w, r) {
+		return
+	}
+
+	cluster := h.backend.Router()
+	node := parts[0]
+	switch parts[1] {
+	case "kill":
+		cluster.KillNode(node)
+	case "freeze":
+		cluster.FreezeNode(node)
+	case "unfreeze":
+		cluster.UnfreezeNode(node)
+	case "partition":
+		cluster.PartitionNode(node)
+	case "reconnect":
+		cluster.ReconnectNode(node)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, cluster.State())
+}
+
+func (h *handler) do(w http.ResponseWriter, actorID string, action func(actorID string) error) {
+	if err := action(actorID); err != nil {
+		writeError(w, err)
+		return
+	}
+	a, ok := h.find(actorID)
+	if !ok {
+		writeError(w, &ErrNotFound{ActorID: actorID})
+		return
+	}
+	writeJSON(w, http.StatusOK, a.State())
+}
+
+// events streams ConnectionEvents of all actors or of the one
+// in the query, restarted actors are picked up on the fly
+func (h *handler) events(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, errorBody("streaming is not supported"))
+		return
+	}
+	only := r.URL.Query().Get("actor")
+	if only != "" {
+		if _, ok := h.find(only); !ok {
+			writeError(w, &ErrNotFound{ActorID: only})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	eventCh := make(chan Event)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// the current instance of every subscribed actor
+	subscribed := map[string]sandbox.Actor{}
+	subscribe := func() {
+		for _, a := range h.backend.Actors() {
+			id := a.GetMeta().ID
+			if (only != "" && id != only) || subscribed[id] == a {
+				continue
+			}
+			subscribed[id] = a
+			go forward(a, eventCh, stopCh)
+		}
+	}
+	subscribe()
+
+	ticker := time.NewTicker(resubscribeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			subscribe()
+		case event := <-eventCh:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func forward(a sandbox.Actor, eventCh chan<- Event, stopCh <-chan struct{}) {
+	monitor := a.Monitor()
+	defer a.Unsubscribe(monitor)
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-a.Liveness():
+			// the stream picks up the restarted instance
+			return
+		case e := <-monitor:
+			select {
+			case eventCh <- newEvent(a.GetMeta().ID, e):
+			case <-stopCh:
+				return
+			}
+		}
+	}
+}
+
+func newEvent(actorID string, e sandbox.ConnectionEvent) Event {
+	rv := Event{
+		Actor:       actorID,
+		Type:        e.EventType.String(),
+		Connections: []sandbox.ConnectionState{},
+	}
+	for _, cw := range e.Connections {
+		rv.Connections = append(rv.Connections, sandbox.NewConnectionState(cw))
+	}
+	sort.Slice(rv.Connections, func(i, j int) bool {
+		return rv.Connections[i].ID < rv.Connections[j].ID
+	})
+	return rv
+}
+
+func (h *handler) find(actorID string) (sandbox.Actor, bool) {
+	for _, a := range h.backend.Actors() {
+		if a.GetMeta().ID == actorID {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, errorBody(fmt.Sprintf("method %s is not allowed", r.Method)))
+	return false
+}
+
+// allowChange accepts POST requests that a cross-origin page can't send
+// without the preflight, which the server doesn't answer
+func allowChange(w http.ResponseWriter, r *http.Request) bool {
+	if !allow(w, r, http.MethodPost) {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, errorBody("Content-Type must be application/json"))
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			writeJSON(w, http.StatusForbidden, errorBody(fmt.Sprintf("origin %s is not allowed", origin)))
+			return false
+		}
+	}
+	return true
+}
+
+func errorBody(msg string) map[string]string {
+	return map[string]string{"error": msg}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*ErrNotFound); ok {
+		writeJSON(w, http.StatusNotFound, errorBody(err.Error()))
+		return
+	}
+	writeJSON(w, http.StatusConflict, errorBody(err.Error()))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+// Server is the admin API listening on the loopback address
+type Server interface {
+	Addr() string
+	Stop() error
+}
+
+type server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Serve starts the admin API, addr must be a loopback address
+// since the sandbox is not supposed to be reachable from outside
+func Serve(addr string, backend Backend) (Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin endpoint '%s' is not on localhost", addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &server{
+		listener: listener,
+		server:   &http.Server{Handler: NewHandler(backend)},
+	}
+	go func() {
+		_ = rv.server.Serve(listener)
+	}()
+	return rv, nil
+}
+
+func (s *server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop closes the listener and open event streams
+func (s *server) Stop() error {
+	return s.server.Close()
+}
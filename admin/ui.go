@@ -0,0 +1,242 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// index serves the page drawing actors grouped by node and connections
+// through them, hops are coloured by HealState from the event stream
+func (h *handler) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(indexHTML))
+}
+
+// indexHTML has no dependencies, so the page works without internet access
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>healsandbox</title>
+<style>
+  body { font-family: sans-serif; margin: 16px; background: #fafafa; }
+  h1 { font-size: 18px; margin: 0 0 8px 0; }
+  #status { color: #666; font-size: 12px; margin-bottom: 8px; }
+  #legend span { display: inline-block; margin-right: 12px; font-size: 12px; }
+  #legend i { display: inline-block; width: 12px; height: 12px; margin-right: 4px; vertical-align: middle; }
+  svg { background: #fff; border: 1px solid #ddd; }
+  .node rect { fill: #f3f6fb; stroke: #9aa9c0; }
+  .node.partitioned rect { stroke: #d33; stroke-dasharray: 6 4; }
+  .node.frozen rect { fill: #e6f3ff; }
+  .actor rect { fill: #fff; stroke: #333; cursor: pointer; }
+  .actor.dead rect { fill: #eee; stroke: #aaa; stroke-dasharray: 4 3; }
+  .actor.dead text { fill: #999; }
+  text { font-size: 12px; }
+  .hop { fill: none; stroke-width: 4; stroke-linecap: round; }
+</style>
+</head>
+<body>
+<h1>healsandbox</h1>
+<div id="status">connecting...</div>
+<div id="legend"></div>
+<svg id="mesh" width="1000" height="400"></svg>
+<script>
+"use strict";
+
+var colors = {
+  Unknown: "#9e9e9e",
+  Requesting: "#b0bec5",
+  Ready: "#2e7d32",
+  WaitSrc: "#f9a825",
+  WaitDst: "#ef6c00",
+  Healing: "#1565c0",
+  Closing: "#c62828"
+};
+
+var columnWidth = 220, actorWidth = 160, actorHeight = 44, rowHeight = 70, topMargin = 50;
+
+// actor ID -> ActorState, connections are updated by the event stream
+var actors = {};
+var nodes = {};
+
+function legend() {
+  var html = "";
+  Object.keys(colors).forEach(function (state) {
+    html += "<span><i style=\"background:" + colors[state] + "\"></i>" + state + "</span>";
+  });
+  document.getElementById("legend").innerHTML = html;
+}
+
+function el(name, attrs, parent) {
+  var e = document.createElementNS("http://www.w3.org/2000/svg", name);
+  Object.keys(attrs).forEach(function (k) { e.setAttribute(k, attrs[k]); });
+  if (parent) { parent.appendChild(e); }
+  return e;
+}
+
+function text(parent, x, y, value) {
+  var t = el("text", { x: x, y: y }, parent);
+  t.textContent = value;
+  return t;
+}
+
+// layout places actors in columns by Meta.Node
+function layout() {
+  var byNode = {};
+  Object.keys(actors).sort().forEach(function (id) {
+    var a = actors[id];
+    (byNode[a.node] = byNode[a.node] || []).push(a);
+  });
+  var positions = {};
+  var columns = Object.keys(byNode).sort();
+  columns.forEach(function (node, i) {
+    byNode[node].forEach(function (a, j) {
+      positions[a.id] = { x: 30 + i * columnWidth, y: topMargin + j * rowHeight };
+    });
+  });
+  return { byNode: byNode, columns: columns, positions: positions };
+}
+
+// paths returns hops of every connection, the longest known list wins
+function paths() {
+  var rv = {};
+  Object.keys(actors).forEach(function (id) {
+    (actors[id].connections || []).forEach(function (c) {
+      var hops = c.hops && c.hops.length ? c.hops : [id];
+      if (!rv[c.id] || rv[c.id].length < hops.length) { rv[c.id] = hops; }
+    });
+  });
+  return rv;
+}
+
+function stateOf(actorID, connID) {
+  var a = actors[actorID];
+  if (!a) { return null; }
+  var found = null;
+  (a.connections || []).forEach(function (c) { if (c.id === connID) { found = c.state; } });
+  return found;
+}
+
+function render() {
+  var svg = document.getElementById("mesh");
+  while (svg.firstChild) { svg.removeChild(svg.firstChild); }
+
+  var l = layout();
+  var rows = 1;
+  l.columns.forEach(function (node, i) {
+    rows = Math.max(rows, l.byNode[node].length);
+    var flags = nodes[node] || {};
+    var g = el("g", { "class": "node" + (flags.partitioned ? " partitioned" : "") + (flags.frozen ? " frozen" : "") }, svg);
+    el("rect", { x: 15 + i * columnWidth, y: 10, width: actorWidth + 30, height: 0, rx: 8 }, g);
+    var label = node;
+    if (flags.frozen) { label += " (frozen)"; }
+    if (flags.partitioned) { label += " (partitioned)"; }
+    text(g, 25 + i * columnWidth, 32, label);
+  });
+  var height = topMargin + rows * rowHeight + 20;
+  svg.setAttribute("width", Math.max(400, 40 + l.columns.length * columnWidth));
+  svg.setAttribute("height", height);
+  Array.prototype.forEach.call(svg.querySelectorAll(".node rect"), function (r) {
+    r.setAttribute("height", height - 20);
+  });
+
+  var connections = paths();
+  Object.keys(connections).sort().forEach(function (connID, n) {
+    var hops = connections[connID];
+    var offset = (n % 5) * 6 - 12;
+    for (var i = 0; i + 1 < hops.length; i++) {
+      var from = l.positions[hops[i]], to = l.positions[hops[i + 1]];
+      if (!from || !to) { continue; }
+      var state = stateOf(hops[i], connID) || "Unknown";
+      var line = el("line", {
+        "class": "hop",
+        x1: from.x + actorWidth / 2, y1: from.y + actorHeight / 2 + offset,
+        x2: to.x + actorWidth / 2, y2: to.y + actorHeight / 2 + offset,
+        stroke: colors[state]
+      }, svg);
+      el("title", {}, line).textContent = connID + ": " + hops[i] + " -> " + hops[i + 1] + " " + state;
+    }
+  });
+
+  Object.keys(l.positions).forEach(function (id) {
+    var a = actors[id], p = l.positions[id];
+    var g = el("g", { "class": "actor" + (a.alive ? "" : " dead") }, svg);
+    el("rect", { x: p.x, y: p.y, width: actorWidth, height: actorHeight, rx: 4 }, g);
+    text(g, p.x + 8, p.y + 18, id);
+    text(g, p.x + 8, p.y + 34, a["class"] + (a.alive ? "" : " (dead)"));
+    (a.connections || []).forEach(function (c, k) {
+      var badge = el("circle", { cx: p.x + actorWidth - 10 - k * 14, cy: p.y + 12, r: 5, fill: colors[c.state] || colors.Unknown }, g);
+      el("title", {}, badge).textContent = c.id + ": " + c.state;
+    });
+    el("title", {}, g).textContent = "click to " + (a.alive ? "kill" : "restart") + " " + id;
+    g.addEventListener("click", function () { fault(id, a.alive ? "kill" : "restart"); });
+  });
+}
+
+function fault(id, action) {
+  fetch("/api/actors/" + encodeURIComponent(id) + "/" + action, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" }
+  })
+    .then(function (r) { return r.json(); })
+    .then(function (body) {
+      if (body.error) { status(body.error); return; }
+      actors[body.id] = body;
+      render();
+    });
+}
+
+function status(s) {
+  document.getElementById("status").textContent = s;
+}
+
+// refresh picks up new and restarted actors and flags of nodes
+function refresh() {
+  Promise.all([
+    fetch("/api/actors").then(function (r) { return r.json(); }),
+    fetch("/api/router").then(function (r) { return r.json(); })
+  ]).then(function (rv) {
+    actors = {};
+    rv[0].forEach(function (a) { actors[a.id] = a; });
+    nodes = {};
+    rv[1].nodes.forEach(function (n) { nodes[n.name] = n; });
+    render();
+  });
+}
+
+function apply(event) {
+  var a = actors[event.actor];
+  if (!a) { return; }
+  var conns = {};
+  (a.connections || []).forEach(function (c) { conns[c.id] = c; });
+  if (event.type === "InitialTransfer") { conns = {}; }
+  event.connections.forEach(function (c) {
+    if (event.type === "Delete") { delete conns[c.id]; } else { conns[c.id] = c; }
+  });
+  a.connections = Object.keys(conns).sort().map(function (id) { return conns[id]; });
+  render();
+}
+
+function stream() {
+  var source = new EventSource("/api/events");
+  source.onopen = function () { status("live"); };
+  source.onerror = function () { status("disconnected, retrying..."); };
+  ["InitialTransfer", "Update", "Delete"].forEach(function (type) {
+    source.addEventListener(type, function (e) { apply(JSON.parse(e.data)); });
+  });
+}
+
+legend();
+refresh();
+stream();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
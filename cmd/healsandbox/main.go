@@ -0,0 +1,67 @@
+// Command healsandbox is the interactive shell for the sandbox,
+// it helps to reproduce an incident before writing a test:
+//
+//	healsandbox                    # interactive
+//	healsandbox incident.txt       # execute the script and exit
+//	healsandbox -i incident.txt    # execute the script and continue interactively
+//
+// Type 'help' for the list of commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/lobkovilya/healsandbox/repl"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	"github.com/sirupsen/logrus"
+	"os"
+)
+
+func main() {
+	verbose := flag.Bool("v", false, "print logs of actors")
+	interactive := flag.Bool("i", false, "continue interactively after the script")
+	policy := flag.String("policy", "node-local", "route policy: node-local or topology")
+	adminAddr := flag.String("admin", "", "serve the admin API on the loopback address, e.g. 127.0.0.1:8080")
+	flag.Parse()
+
+	// the supervisor logs with the standard logger too
+	logrus.SetLevel(logrus.WarnLevel)
+	if *verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	opts := []repl.Option{}
+	switch *policy {
+	case "node-local":
+	case "topology":
+		opts = append(opts, repl.WithRouterOptions(sandbox.WithRoutePolicy(topology.RoutePolicy)))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown route policy '%s'\n", *policy)
+		os.Exit(2)
+	}
+
+	shell := repl.NewShell(os.Stdout, opts...)
+	defer shell.Close()
+
+	if *adminAddr != "" {
+		if err := shell.Exec("serve " + *adminAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		script, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		shell.Run(script, false)
+		script.Close()
+		if !*interactive {
+			return
+		}
+	}
+	shell.Run(os.Stdin, true)
+}
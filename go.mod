@@ -5,4 +5,5 @@ go 1.13
 require (
 	github.com/onsi/gomega v1.7.1
 	github.com/sirupsen/logrus v1.4.2
+	gopkg.in/yaml.v2 v2.2.4
 )
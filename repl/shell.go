@@ -0,0 +1,557 @@
+package repl
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/lobkovilya/healsandbox/admin"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shell executes commands that drive actors of one Router, see the help command,
+// the admin API started by 'serve' operates on the same actors
+type Shell interface {
+	admin.Backend
+
+	// Exec executes one command line, empty lines and comments are ignored
+	Exec(line string) error
+	// Run executes lines of in until it ends or 'quit' is executed,
+	// errors of commands are printed and don't stop it
+	Run(in io.Reader, prompt bool)
+	// Close kills all actors and stops watchers
+	Close()
+}
+
+// ErrQuit is returned by Exec for the 'quit' command
+var ErrQuit = fmt.Errorf("quit")
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+type shell struct {
+	outMtx sync.Mutex
+	out    io.Writer
+
+	logger  sandbox.Logger
+	router  sandbox.Router
+	sup     sandbox.Supervisor
+	joinSup func()
+
+	mtx    sync.Mutex
+	actors map[string]sandbox.Actor
+	// stores keep connections of the actor across restarts
+	stores   map[string]sandbox.ConnectionStore
+	watchers map[string]chan struct{}
+	wg       sync.WaitGroup
+	server   admin.Server
+
+	commands []command
+}
+
+// Option configures the Shell created by NewShell
+type Option func(s *shell)
+
+// WithLogger sets the Logger of actors created by the Shell
+func WithLogger(logger sandbox.Logger) Option {
+	return func(s *shell) {
+		s.logger = logger
+	}
+}
+
+// WithRouterOptions configures the Router of the Shell, e.g. the route policy
+func WithRouterOptions(opts ...sandbox.RouterOption) Option {
+	return func(s *shell) {
+		s.router = sandbox.NewRouter(opts...)
+	}
+}
+
+func NewShell(out io.Writer, opts ...Option) Shell {
+	rv := &shell{
+		out:      out,
+		logger:   sandbox.DefaultLogger,
+		router:   sandbox.NewRouter(),
+		actors:   map[string]sandbox.Actor{},
+		stores:   map[string]sandbox.ConnectionStore{},
+		watchers: map[string]chan struct{}{},
+	}
+
+	for _, o := range opts {
+		o(rv)
+	}
+
+	rv.sup = sandbox.NewSupervisor("healsandbox", sandbox.SupervisorPolicy{Logger: rv.logger})
+	joinCh := make(chan struct{})
+	go func() {
+		rv.sup.Run()
+		close(joinCh)
+	}()
+	rv.joinSup = func() {
+		rv.sup.Kill()
+		<-joinCh
+	}
+
+	rv.commands = []command{
+		{"add", "add <nsc|nse|forwarder> <id> <node> | add nsmgr <node>", "create the actor, it's started by 'start'", rv.add},
+		{"start", "start <actor>...", "run actors and wait until they are registered", rv.start},
+		{"request", "request [-paths=<n>] <actor> <conn> <dst> | <hop> <hop>...", "request the connection from the actor to the destination selector or along the route", rv.request},
+		{"close", "close <actor> <conn>", "close the connection on the actor and downstream", rv.close},
+		{"kill", "kill <actor>", "kill the actor", rv.kill},
+		{"restart", "restart <actor>", "start the new instance of the killed actor, it recovers connections", rv.restart},
+		{"kill-node", "kill-node <node>", "kill all actors of the node at once", rv.nodeAction("kill-node", func(node string) { rv.router.KillNode(node) })},
+		{"freeze", "freeze <node>", "make actors of the node unresponsive", rv.nodeAction("freeze", rv.router.FreezeNode)},
+		{"unfreeze", "unfreeze <node>", "undo 'freeze'", rv.nodeAction("unfreeze", rv.router.UnfreezeNode)},
+		{"partition", "partition <node>", "cut the node from the rest of the cluster", rv.nodeAction("partition", rv.router.PartitionNode)},
+		{"reconnect", "reconnect <node>", "undo 'partition'", rv.nodeAction("reconnect", rv.router.ReconnectNode)},
+		{"watch", "watch <actor>", "print monitor events of the actor as they happen", rv.watch},
+		{"unwatch", "unwatch <actor>", "stop printing monitor events of the actor", rv.unwatch},
+		{"state", "state [table|json|yaml]", "print the snapshot of all actors", rv.state},
+		{"serve", "serve <addr>", "start the admin API and the web UI on the loopback address", rv.serve},
+		{"sleep", "sleep <duration>", "wait, e.g. for the healer in scripts", rv.sleep},
+		{"help", "help", "print this help", rv.help},
+		{"quit", "quit", "kill all actors and exit", func([]string) error { return ErrQuit }},
+	}
+	return rv
+}
+
+func (s *shell) Exec(line string) error {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	for _, c := range s.commands {
+		if c.name == fields[0] {
+			return c.run(fields[1:])
+		}
+	}
+	return fmt.Errorf("unknown command '%s', see 'help'", fields[0])
+}
+
+func (s *shell) Run(in io.Reader, prompt bool) {
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			s.printf("> ")
+		}
+		if !scanner.Scan() {
+			return
+		}
+		err := s.Exec(scanner.Text())
+		if err == ErrQuit {
+			return
+		}
+		if err != nil {
+			s.printf("error: %v\n", err)
+		}
+	}
+}
+
+func (s *shell) Close() {
+	s.mtx.Lock()
+	for id, stopCh := range s.watchers {
+		close(stopCh)
+		delete(s.watchers, id)
+	}
+	server := s.server
+	s.server = nil
+	s.mtx.Unlock()
+
+	if server != nil {
+		_ = server.Stop()
+	}
+	s.joinSup()
+	s.wg.Wait()
+}
+
+func (s *shell) printf(format string, args ...interface{}) {
+	s.outMtx.Lock()
+	defer s.outMtx.Unlock()
+	fmt.Fprintf(s.out, format, args...)
+}
+
+func (s *shell) add(args []string) error {
+	var meta sandbox.Meta
+	switch {
+	case len(args) == 2 && args[0] == "nsmgr":
+		meta = topology.NewNSMgr(args[1])
+	case len(args) == 3 && args[0] == "nsc":
+		meta = topology.NewNSC(args[1], args[2])
+	case len(args) == 3 && args[0] == "nse":
+		meta = topology.NewNSE(args[1], args[2])
+	case len(args) == 3 && args[0] == "forwarder":
+		meta = topology.NewForwarder(args[1], args[2])
+	default:
+		return s.usage("add")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.actors[meta.ID]; ok {
+		return fmt.Errorf("actor '%s' already exists", meta.ID)
+	}
+	s.stores[meta.ID] = sandbox.NewMemoryConnectionStore()
+	s.actors[meta.ID] = s.newActor(meta)
+	s.printf("added %s\n", meta.ID)
+	return nil
+}
+
+func (s *shell) newActor(meta sandbox.Meta) sandbox.Actor {
+	return sandbox.NewActor(meta, s.router,
+		sandbox.WithConnectionStore(s.stores[meta.ID]),
+		sandbox.WithLogger(s.logger))
+}
+
+func (s *shell) start(args []string) error {
+	if len(args) == 0 {
+		return s.usage("start")
+	}
+	actors := []sandbox.Actor{}
+	for _, id := range args {
+		a, err := s.actor(id)
+		if err != nil {
+			return err
+		}
+		if !a.IsAlive() {
+			return fmt.Errorf("actor '%s' is dead, see 'restart'", id)
+		}
+		if s.sup.Child(id) != nil {
+			return fmt.Errorf("actor '%s' is already started", id)
+		}
+		actors = append(actors, a)
+	}
+
+	for _, a := range actors {
+		s.run(a)
+	}
+	for _, a := range actors {
+		if err := waitRegistered(a); err != nil {
+			return err
+		}
+		s.printf("%s registered\n", a.GetMeta().ID)
+	}
+	return nil
+}
+
+// registerTimeout bounds the wait of 'start' and 'restart', the actor
+// may die before it registers
+const registerTimeout = 10 * time.Second
+
+func waitRegistered(a sandbox.Actor) error {
+	select {
+	case <-a.IsRegistered():
+		return nil
+	case <-time.After(registerTimeout):
+		return fmt.Errorf("actor '%s' isn't registered within %v", a.GetMeta().ID, registerTimeout)
+	}
+}
+
+func (s *shell) run(a sandbox.Actor) {
+	s.sup.StartChild(sandbox.ChildSpec{
+		ID:      a.GetMeta().ID,
+		Start:   func() sandbox.Child { return a },
+		Restart: sandbox.Temporary,
+	})
+}
+
+// request takes the destination selector or the whole route, hops
+// are separated by spaces as selectors contain commas
+func (s *shell) request(args []string) error {
+	flags := flag.NewFlagSet("request", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	paths := flags.Int("paths", 0, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 3 {
+		return s.usage("request")
+	}
+	args = flags.Args()
+	a, err := s.actor(args[0])
+	if err != nil {
+		return err
+	}
+
+	request := sandbox.Request{
+		ConnectionID: args[1],
+		Paths:        *paths,
+	}
+	if len(args) == 3 {
+		request.Dst = args[2]
+	} else {
+		request.Route = args[2:]
+	}
+
+	conn, err := a.Request(request)
+	if err != nil {
+		return err
+	}
+	s.printf("%s established, hops %v\n", conn.ID, conn.Hops())
+	return nil
+}
+
+func (s *shell) close(args []string) error {
+	if len(args) != 2 {
+		return s.usage("close")
+	}
+	a, err := s.actor(args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.Close(args[1]); err != nil {
+		return err
+	}
+	s.printf("%s closed\n", args[1])
+	return nil
+}
+
+func (s *shell) kill(args []string) error {
+	if len(args) != 1 {
+		return s.usage("kill")
+	}
+	if err := s.Kill(args[0]); err != nil {
+		return err
+	}
+	s.printf("%s killed\n", args[0])
+	return nil
+}
+
+func (s *shell) restart(args []string) error {
+	if len(args) != 1 {
+		return s.usage("restart")
+	}
+	if err := s.Restart(args[0]); err != nil {
+		return err
+	}
+	s.printf("%s restarted\n", args[0])
+	return nil
+}
+
+func (s *shell) Router() sandbox.Router {
+	return s.router
+}
+
+func (s *shell) Actors() []sandbox.Actor {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	rv := make([]sandbox.Actor, 0, len(s.actors))
+	for _, a := range s.actors {
+		rv = append(rv, a)
+	}
+	return rv
+}
+
+func (s *shell) Kill(actorID string) error {
+	a, err := s.actor(actorID)
+	if err != nil {
+		return err
+	}
+	if !a.IsAlive() {
+		return fmt.Errorf("actor '%s' is already dead", actorID)
+	}
+	a.Kill()
+	return nil
+}
+
+// Restart replaces the killed actor with the new instance using the same
+// connection store, so it recovers connections, watchers move to it
+func (s *shell) Restart(actorID string) error {
+	// the check and the replacement are atomic, concurrent restarts
+	// of the actor start one instance
+	s.mtx.Lock()
+	old, ok := s.actors[actorID]
+	if !ok {
+		s.mtx.Unlock()
+		return &admin.ErrNotFound{ActorID: actorID}
+	}
+	if old.IsAlive() {
+		s.mtx.Unlock()
+		return fmt.Errorf("actor '%s' is alive, kill it first", actorID)
+	}
+	a := s.newActor(old.GetMeta())
+	s.actors[actorID] = a
+	_, watched := s.watchers[actorID]
+	s.mtx.Unlock()
+
+	if watched {
+		_ = s.unwatch([]string{actorID})
+	}
+	s.run(a)
+	if err := waitRegistered(a); err != nil {
+		return err
+	}
+	if watched {
+		_ = s.watch([]string{actorID})
+	}
+	return nil
+}
+
+func (s *shell) nodeAction(name string, action func(node string)) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return s.usage(name)
+		}
+		action(args[0])
+		s.printf("%s %s\n", name, args[0])
+		return nil
+	}
+}
+
+func (s *shell) watch(args []string) error {
+	if len(args) != 1 {
+		return s.usage("watch")
+	}
+	a, err := s.actor(args[0])
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.watchers[args[0]]; ok {
+		return fmt.Errorf("actor '%s' is already watched", args[0])
+	}
+	stopCh := make(chan struct{})
+	s.watchers[args[0]] = stopCh
+
+	monitor := a.Monitor()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer a.Unsubscribe(monitor)
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event := <-monitor:
+				s.printEvent(args[0], event)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *shell) printEvent(actorID string, event sandbox.ConnectionEvent) {
+	ids := make([]string, 0, len(event.Connections))
+	for id := range event.Connections {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if len(ids) == 0 {
+		s.printf("[%s] %v: no connections\n", actorID, event.EventType)
+	}
+	for _, id := range ids {
+		s.printf("[%s] %v %s State = %v\n", actorID, event.EventType, id, event.Connections[id].State)
+	}
+}
+
+func (s *shell) unwatch(args []string) error {
+	if len(args) != 1 {
+		return s.usage("unwatch")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stopCh, ok := s.watchers[args[0]]
+	if !ok {
+		return fmt.Errorf("actor '%s' is not watched", args[0])
+	}
+	close(stopCh)
+	delete(s.watchers, args[0])
+	return nil
+}
+
+func (s *shell) state(args []string) error {
+	format := "table"
+	if len(args) > 1 {
+		return s.usage("state")
+	}
+	if len(args) == 1 {
+		format = args[0]
+	}
+
+	state := sandbox.Snapshot(s.Actors()...)
+
+	s.outMtx.Lock()
+	defer s.outMtx.Unlock()
+	switch format {
+	case "table":
+		return state.WriteTable(s.out)
+	case "json":
+		return state.WriteJSON(s.out)
+	case "yaml":
+		return state.WriteYAML(s.out)
+	default:
+		return fmt.Errorf("unknown format '%s'", format)
+	}
+}
+
+func (s *shell) serve(args []string) error {
+	if len(args) != 1 {
+		return s.usage("serve")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.server != nil {
+		return fmt.Errorf("admin API is already served on %s", s.server.Addr())
+	}
+	server, err := admin.Serve(args[0], s)
+	if err != nil {
+		return err
+	}
+	s.server = server
+	s.printf("admin API is served on http://%s/api, web UI on http://%s/\n", server.Addr(), server.Addr())
+	return nil
+}
+
+func (s *shell) sleep(args []string) error {
+	if len(args) != 1 {
+		return s.usage("sleep")
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+	<-time.After(d)
+	return nil
+}
+
+func (s *shell) help([]string) error {
+	s.outMtx.Lock()
+	defer s.outMtx.Unlock()
+	for _, c := range s.commands {
+		fmt.Fprintf(s.out, "%s\n\t%s\n", c.usage, c.help)
+	}
+	return nil
+}
+
+func (s *shell) usage(name string) error {
+	for _, c := range s.commands {
+		if c.name == name {
+			return fmt.Errorf("usage: %s", c.usage)
+		}
+	}
+	return fmt.Errorf("unknown command '%s'", name)
+}
+
+func (s *shell) actor(id string) (sandbox.Actor, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	a, ok := s.actors[id]
+	if !ok {
+		return nil, &admin.ErrNotFound{ActorID: id}
+	}
+	return a, nil
+}
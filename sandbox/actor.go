@@ -2,30 +2,67 @@ package sandbox
 
 import (
 	"fmt"
-	"github.com/sirupsen/logrus"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Request struct {
-	// List of class that Request has to pass
+	// List of hops that Request has to pass, see Selector
 	Route        []string
 	Current      int
 	ConnectionID string
+	// Selector of the destination, the first hop plans
+	// the Route with Router.PlanRoute if it's not set
+	Dst string
 
 	From Actor
+	// Actor that initiated the connection, it is set by the first hop
+	Src Meta
+
+	// Number of disjoint paths, the first hop that has several
+	// candidates for the next hop establishes them, the extra
+	// paths are hot standbys
+	Paths int
+	// Index of the path, hops of the path choose candidates by it
+	Path int
+	// Actors of the other paths of the connection, hops of the path
+	// choose other candidates while there are any
+	Avoid []string
+
+	// Addresses the connection had, the endpoint keeps them if it can
+	IPContext IPContext
+	// Span of the previous hop
+	Trace SpanContext
+
+	// Mechanisms in the order of preference, every hop drops
+	// the ones it doesn't support
+	MechanismPreferences []Mechanism
+	// Actors the request has passed, every hop adds itself
+	Segments []PathSegment
+	Labels   map[string]string
 }
 
 type Actor interface {
 	Request(request Request) (Connection, error)
-	Close(connID string)
+	// Close closes the connection on the Actor and downstream,
+	// it returns when every reachable hop acknowledged it
+	Close(connID string) error
+	// NotifyClosed is called by the next peer that closed the connection
+	NotifyClosed(connID string, next Actor)
+	// ForwardingEntry is the data plane of the connection, see Probe
+	ForwardingEntry(connID string) (ForwardingEntry, bool)
 	Monitor() <-chan ConnectionEvent
+	// Unsubscribe stops sending events to the channel returned by Monitor
+	Unsubscribe(ch <-chan ConnectionEvent)
 	Run()
 
 	Liveness() <-chan struct{}
 	IsRegistered() <-chan struct{}
 
 	GetMeta() Meta
-	PrintState()
+	// State returns the snapshot of the Actor and its connections
+	State() ActorState
 
 	Kill()
 	IsAlive() bool
@@ -39,6 +76,9 @@ type Meta struct {
 	// Does Actor produces some 'network' side-effects
 	// like kernel-interface, routing tables and etc...
 	NetworkHolder bool
+
+	// Arbitrary labels for route selectors
+	Labels map[string]string
 }
 
 func (m Meta) Clone() Meta {
@@ -47,6 +87,32 @@ func (m Meta) Clone() Meta {
 		Class:         m.Class,
 		Node:          m.Node,
 		NetworkHolder: m.NetworkHolder,
+		Labels:        cloneLabels(m.Labels),
+	}
+}
+
+func cloneLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	rv := make(map[string]string, len(labels))
+	for k, v := range labels {
+		rv[k] = v
+	}
+	return rv
+}
+
+// Label returns the value of the label, 'id', 'class' and 'node' are Meta fields
+func (m Meta) Label(key string) string {
+	switch key {
+	case "id":
+		return m.ID
+	case "class":
+		return m.Class
+	case "node":
+		return m.Node
+	default:
+		return m.Labels[key]
 	}
 }
 
@@ -58,22 +124,106 @@ type actor struct {
 
 	router Router
 	healer Healer
+	store  ConnectionStore
+	// network side-effects of NetworkHolder
+	resources ResourceRegistry
+	ipam      IPAM
+
+	interceptors []Interceptor
+	mechanisms   []string
+	metrics      *Metrics
+	tracer       tracer
+	logger       Logger
+	recorder     Recorder
+
+	refreshInterval time.Duration
+	ttl             time.Duration
+	healerOpts      []HealerOption
 
 	regCh  chan struct{}
 	killCh chan struct{}
 	killed bool
 }
 
-func NewActor(meta Meta, router Router) Actor {
+// Option configures the Actor created by NewActor
+type Option func(a *actor)
+
+// WithConnectionStore sets the backend for connections of the Actor,
+// the new Actor with the same store recovers connections on Run
+func WithConnectionStore(store ConnectionStore) Option {
+	return func(a *actor) {
+		a.store = store
+	}
+}
+
+// WithRefresh makes the Actor request connections it initiated
+// again every interval, so the rest of the route keeps them
+func WithRefresh(interval time.Duration) Option {
+	return func(a *actor) {
+		a.refreshInterval = interval
+	}
+}
+
+// WithConnectionTTL makes the Actor close connections
+// that the source didn't request again within ttl
+func WithConnectionTTL(ttl time.Duration) Option {
+	return func(a *actor) {
+		a.ttl = ttl
+	}
+}
+
+// WithLogger sets the Logger of the Actor and its healer,
+// entries get fields with ID, class and node of the Actor
+func WithLogger(logger Logger) Option {
+	return func(a *actor) {
+		a.logger = logger
+	}
+}
+
+// WithMakeBeforeBreak makes the Actor heal connections with a new
+// segment, the old one is closed after the switch, see MakeBeforeBreak
+func WithMakeBeforeBreak() Option {
+	return func(a *actor) {
+		a.healerOpts = append(a.healerOpts, MakeBeforeBreak())
+	}
+}
+
+func NewActor(meta Meta, router Router, opts ...Option) Actor {
 	rv := &actor{
-		Meta:   meta,
-		router: router,
-		regCh:  make(chan struct{}),
-		killCh: make(chan struct{}),
+		Meta:      meta,
+		router:    router,
+		store:     NewMemoryConnectionStore(),
+		resources: NewResourceRegistry(),
+		metrics:   DefaultMetrics,
+		logger:    DefaultLogger,
+		regCh:     make(chan struct{}),
+		killCh:    make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(rv)
 	}
+	rv.logger = rv.logger.WithFields(Fields{
+		ActorIDField: rv.ID,
+		ClassField:   rv.Class,
+		NodeField:    rv.Node,
+	})
 
-	rv.connectionMonitor = newConnectionMonitor(rv.logWithConn)
-	rv.healer = NewCloseHealer(rv.router, rv.connectionMonitor, rv.logWithConn)
+	rv.connectionMonitor = newConnectionMonitor(rv.store, rv.logWithConn)
+	rv.connectionMonitor.id = rv.ID
+	rv.connectionMonitor.metrics = rv.metrics
+	if rv.recorder != nil {
+		if rv.tracer.exporter != nil {
+			rv.tracer.exporter = multiExporter{rv.tracer.exporter, rv.recorder}
+		} else {
+			rv.tracer.exporter = rv.recorder
+		}
+		rv.connectionMonitor.recorded = func(event ConnectionEvent) {
+			rv.recorder.Event(rv.ID, event)
+		}
+	}
+	healerOpts := append(rv.healerOpts, WithHealerMetrics(rv.metrics), WithHealerSpanExporter(rv.tracer.exporter))
+	rv.healer = NewCloseHealer(rv.router, rv, rv, rv.logger, healerOpts...)
 
 	return rv
 }
@@ -86,60 +236,274 @@ func (a *actor) GetMeta() Meta {
 }
 
 func (a *actor) Request(request Request) (Connection, error) {
+	begin := time.Now()
+	span := a.tracer.start("request", a.ID, request.ConnectionID, request.Trace)
+	span.SetAttribute("class", a.Class)
+	span.SetAttribute("node", a.Node)
+	span.SetAttribute("hop", fmt.Sprint(request.Current))
+	if trace := span.Context(); trace.IsValid() {
+		request.Trace = trace
+	}
+
+	conn, err := a.request(request)
+	span.SetError(err)
+	span.End()
+
+	a.metrics.Requests.Add(1, a.Class, result(err))
+	a.metrics.RequestDuration.Observe(time.Since(begin).Seconds(), a.Class)
+	return conn, err
+}
+
+func (a *actor) request(request Request) (Connection, error) {
+	cw, conn, err := a.admit(&request)
+	if err != nil || cw == nil {
+		return conn, err
+	}
+
+	// the healer owns the connection, it applies the accepted request
+	// and refreshes the next hop if the connection is ready
+	joinFunc := a.healer.Requested(request)
+	joinFunc()
+	if latest, err := a.latest(request.ConnectionID); err == nil {
+		cw = latest
+	}
+	return a.upstream(cw), nil
+}
+
+// admit accepts the request under the read lock and establishes the new
+// connection, so Kill doesn't miss it. The existing connection is returned
+// to the healer that is joined without the lock, it asks for the Meta of the Actor
+func (a *actor) admit(request *Request) (*ConnectionWrapper, Connection, error) {
 	a.mtx.RLock()
 	defer a.mtx.RUnlock()
 
-	a.log(fmt.Sprintf("request accepted: %v", request))
+	a.logWithConn(request.ConnectionID, "request accepted: %v", *request)
 	if a.killed {
-		return Connection{}, fmt.Errorf("sandbox '%s' is dead", a.ID)
+		return nil, Connection{}, fmt.Errorf("sandbox '%s' is dead", a.ID)
+	}
+	if a.router.IsFrozen(a.Node) {
+		return nil, Connection{}, fmt.Errorf("sandbox '%s' is frozen", a.ID)
+	}
+
+	if request.Src.ID == "" {
+		request.Src = a.Meta.Clone()
 	}
 
-	if cw, err := a.Get(request.ConnectionID); err == nil {
-		joinFunc := a.healer.Emit(SrcUp, request.ConnectionID)
-		joinFunc()
-		return cw.Connection, nil
+	if err := a.accept(request); err != nil {
+		return nil, Connection{}, err
+	}
+
+	if cw, err := a.latest(request.ConnectionID); err == nil {
+		return cw, Connection{}, nil
+	}
+	conn, err := a.establish(*request)
+	return nil, conn, err
+}
+
+// establish sets up the new connection, see admit
+func (a *actor) establish(request Request) (Connection, error) {
+	if len(request.Route) == 0 {
+		route, err := a.router.PlanRoute(request.Src, request.Dst)
+		if err != nil {
+			return Connection{}, err
+		}
+		a.logWithConn(request.ConnectionID, "route planned: %v", route)
+		request.Route = route
 	}
 
 	if request.Current == len(request.Route)-1 {
-		conn := Connection{
-			ID:        request.ConnectionID,
-			LastActor: a.ID,
+		conn := endpointConnection(request, a.ID)
+		if a.ipam != nil {
+			ipContext, err := a.ipam.Allocate(request.ConnectionID, request.IPContext)
+			if err != nil {
+				return Connection{}, err
+			}
+			conn.IPContext = ipContext
 		}
-		a.storeConn(NewConnectionWrapper(conn, request, nil, a.logWithConn))
-		return conn, nil
+		cw := NewConnectionWrapper(conn, request, nil, a.logWithConn)
+		a.storeConn(cw)
+		return a.upstream(cw), nil
 	}
 
-	available := a.router.FindActors(request.Route[request.Current+1])
+	next, err := a.SelectNext(request)
+	if err != nil {
+		return Connection{}, err
+	}
+
+	var standby []Actor
+	if request.Paths > 1 {
+		if standby = a.selectStandby(request, next); len(standby) > 0 {
+			// the connection branches here
+			request.Paths = 0
+		}
+	}
+
+	conn, err := a.RequestNext(request, next)
+	if err != nil {
+		return Connection{}, err
+	}
+
+	cw := NewConnectionWrapper(conn, request, next, a.logWithConn)
+	avoid := segmentNames(conn.Segments)
+	for i, peer := range standby {
+		path := Path{Index: i + 1, Next: peer}
+		// paths share addresses of the connection
+		standbyRequest := pathRequest(request, path.Index)
+		standbyRequest.IPContext = conn.IPContext
+		standbyRequest.Avoid = avoid
+		standbyConn, err := a.RequestNext(standbyRequest, peer)
+		if err != nil {
+			a.warnWithConn(request.ConnectionID, "standby path %d is not established: %v", path.Index, err)
+			continue
+		}
+		avoid = append(avoid, segmentNames(standbyConn.Segments)...)
+		cw.standby = append(cw.standby, path)
+	}
+	a.storeConn(cw)
+
+	return a.upstream(cw), nil
+}
+
+// SelectNext resolves the next hop of the request
+func (a *actor) SelectNext(request Request) (Actor, error) {
+	hop := request.Route[request.Current+1]
+	found, err := a.router.FindActors(hop, request.Src, a.Meta)
+	if err != nil {
+		return nil, err
+	}
+	available := a.reachable(found)
 	if len(available) == 0 {
-		return Connection{}, fmt.Errorf("no actors with class '%s' are available", request.Route[request.Current+1])
+		return nil, fmt.Errorf("no actors for hop '%s' are available", hop)
+	}
+	// paths of the connection keep apart while there are enough candidates
+	if disjoint := without(available, request.Avoid); len(disjoint) > 0 {
+		available = disjoint
+	}
+	return available[request.Path%len(available)], nil
+}
+
+// without returns actors whose IDs aren't listed in ids
+func without(actors []Actor, ids []string) (rv []Actor) {
+	excluded := map[string]bool{}
+	for _, id := range ids {
+		excluded[id] = true
 	}
+	for _, actor := range actors {
+		if !excluded[actor.GetMeta().ID] {
+			rv = append(rv, actor)
+		}
+	}
+	return rv
+}
+
+func segmentNames(segments []PathSegment) []string {
+	rv := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		rv = append(rv, segment.Name)
+	}
+	return rv
+}
 
-	conn, err := available[0].Request(Request{
+// selectStandby returns candidates for the next hop other than next,
+// no more than the request needs for extra paths
+func (a *actor) selectStandby(request Request, next Actor) (rv []Actor) {
+	found, err := a.router.FindActors(request.Route[request.Current+1], request.Src, a.Meta)
+	if err != nil {
+		return nil
+	}
+	for _, peer := range without(a.reachable(found), request.Avoid) {
+		if len(rv) == request.Paths-1 {
+			break
+		}
+		if peer != next {
+			rv = append(rv, peer)
+		}
+	}
+	return rv
+}
+
+// RequestNext passes the request received by the Actor to the next hop
+func (a *actor) RequestNext(request Request, next Actor) (Connection, error) {
+	return next.Request(Request{
 		Route:        request.Route,
 		Current:      request.Current + 1,
 		ConnectionID: request.ConnectionID,
+		Dst:          request.Dst,
 		From:         a,
+		Src:          request.Src,
+		Paths:        request.Paths,
+		Path:         request.Path,
+		Avoid:        request.Avoid,
+		IPContext:    request.IPContext,
+		Trace:        request.Trace,
+
+		MechanismPreferences: request.MechanismPreferences,
+		Segments:             request.Segments,
+		Labels:               request.Labels,
 	})
+}
 
-	if err != nil {
-		return Connection{}, err
+// Refresh passes the request of the ready connection to the next hop,
+// standby paths are refreshed as well
+func (a *actor) Refresh(cw *ConnectionWrapper) {
+	if cw.next == nil || cw.State != Ready {
+		return
 	}
+	if _, err := a.RequestNext(cw.nextRequest(), cw.next); err != nil {
+		a.warnWithConn(cw.ID, "refresh failed: %v", err)
+	}
+	for _, path := range cw.Standby() {
+		if _, err := a.RequestNext(pathRequest(cw.request, path.Index), path.Next); err != nil {
+			a.warnWithConn(cw.ID, "refresh of standby path %d failed: %v", path.Index, err)
+		}
+	}
+}
+
+// keepalive refreshes the latest snapshot of the connection
+func (a *actor) keepalive(connID string) {
+	if cw, err := a.latest(connID); err == nil {
+		a.Refresh(cw)
+	}
+}
 
-	a.storeConn(NewConnectionWrapper(conn, request, available[0], a.logWithConn))
+func (a *actor) Close(connID string) error {
+	if !a.IsAlive() {
+		return fmt.Errorf("sandbox '%s' is dead", a.ID)
+	}
 
-	return conn, nil
+	cw, err := a.Get(connID)
+	if err != nil {
+		// already closed
+		return nil
+	}
+
+	joinFunc := a.healer.Emit(Close, connID)
+	joinFunc()
+	return cw.closeErr
 }
 
-func (a *actor) Close(connID string) {
-	a.healer.Emit(SrcDown, connID)
+func (a *actor) NotifyClosed(connID string, next Actor) {
+	if !a.IsAlive() {
+		return
+	}
+
+	cw, err := a.latest(connID)
+	if err != nil {
+		// the connection may know the next peer by PathID
+		if cw, err = a.latest(pathOwner(connID)); err != nil {
+			return
+		}
+	}
+	if cw.next != next || PathID(cw.ID, cw.path) != connID {
+		return
+	}
+	a.healer.Emit(DstClosed, cw.ID)
 }
 
 func (a *actor) Run() {
 	a.log("Started!")
 
 	a.router.Register(a)
-	close(a.regCh)
-	a.log("Registered!")
 
 	stopCh := make(chan struct{})
 	joinCh := make(chan struct{})
@@ -148,23 +512,145 @@ func (a *actor) Run() {
 		close(joinCh)
 	}()
 
+	a.recover()
+	close(a.regCh)
+	a.log("Registered!")
+
 	<-a.killCh
 	close(stopCh)
 	<-joinCh
 	a.log("Killed!")
 }
 
+// recover restores connections from the store, peers are looked up by ID.
+// Connection whose source is gone goes to 'WaitSrc' and will be closed
+// unless the source requests it again. Connections that were waiting for
+// a peer go through the same event again, so the healer restarts timers
+func (a *actor) recover() {
+	records, err := a.store.Load()
+	if err != nil {
+		a.log("failed to recover connections: %v", err)
+		return
+	}
+
+	for _, r := range records {
+		request := Request{
+			Route:        r.Route,
+			Current:      r.Current,
+			ConnectionID: r.Connection.ID,
+			Dst:          r.Dst,
+			Src:          r.Src,
+			Path:         r.Path,
+
+			MechanismPreferences: r.MechanismPreferences,
+			Segments:             r.Segments,
+			Labels:               r.Labels,
+		}
+
+		srcLost := false
+		if r.FromID != "" {
+			request.From = a.router.FindActor(r.FromID)
+			if request.From == nil || !request.From.IsAlive() {
+				request.From = nil
+				srcLost = true
+			}
+		}
+
+		var next Actor
+		if r.NextID != "" {
+			next = a.router.FindActor(r.NextID)
+		}
+
+		if a.ipam != nil && r.NextID == "" {
+			if _, err := a.ipam.Allocate(r.Connection.ID, r.Connection.IPContext); err != nil {
+				a.warnWithConn(r.Connection.ID, "failed to restore addresses: %v", err)
+			}
+		}
+
+		cw := NewConnectionWrapper(r.Connection, request, next, a.logWithConn)
+		cw.path = r.ActivePath
+		for _, index := range sortedPaths(r.Standby) {
+			if peer := a.router.FindActor(r.Standby[index]); peer != nil {
+				cw.standby = append(cw.standby, Path{Index: index, Next: peer})
+			}
+		}
+
+		a.logWithConn(r.Connection.ID, "recovered in State %v", r.State)
+		a.storeConn(cw)
+		switch {
+		case srcLost || r.State == WaitSrc:
+			a.healer.Emit(SrcDown, r.Connection.ID)
+		case r.State == WaitDst || r.State == Healing || (r.NextID != "" && next == nil):
+			// the interrupted heal starts over, the next peer
+			// may be gone while the actor was down
+			a.healer.Emit(DstDown, r.Connection.ID)
+		}
+	}
+}
+
+func sortedPaths(standby map[int]string) []int {
+	rv := make([]int, 0, len(standby))
+	for index := range standby {
+		rv = append(rv, index)
+	}
+	sort.Ints(rv)
+	return rv
+}
+
 func (a *actor) storeConn(cw *ConnectionWrapper) {
+	a.program(cw)
+	// the wrapper is set up before the healer owns it
+	cw.Monitor(a.healer, a.waitDown)
+	if cw.request.Current == 0 {
+		if a.refreshInterval > 0 {
+			cw.Keepalive(a.refreshInterval, a.keepalive)
+		}
+	} else if a.ttl > 0 {
+		cw.Expire(a.ttl)
+	}
 	a.Update(cw)
-	go cw.Monitor(a.healer)
+	cw.stored()
+}
+
+func (a *actor) reachable(actors []Actor) (rv []Actor) {
+	for _, peer := range actors {
+		if a.router.Reachable(a.Node, peer.GetMeta().Node) {
+			rv = append(rv, peer)
+		}
+	}
+	return
+}
+
+// waitDown returns an error when the peer dies or becomes unreachable,
+// and nil when stopCh is closed
+func (a *actor) waitDown(peer Actor, stopCh <-chan struct{}) error {
+	meta := peer.GetMeta()
+	for {
+		changedCh := a.router.Changed()
+		if !a.router.Reachable(a.Node, meta.Node) {
+			return fmt.Errorf("peer %v is unreachable", meta.ID)
+		}
+
+		select {
+		case <-peer.Liveness():
+			return fmt.Errorf("peer %v is dead", meta.ID)
+		case <-stopCh:
+			return nil
+		case <-changedCh:
+		}
+	}
+}
+
+func (a *actor) log(format string, args ...interface{}) {
+	a.logger.Infof(format, args...)
 }
 
-func (a *actor) log(s string) {
-	logrus.Infof("%v: %s", a.ID, s)
+func (a *actor) logWithConn(connID, format string, args ...interface{}) {
+	a.logger.WithFields(Fields{ConnIDField: connID}).Infof(format, args...)
 }
 
-func (a *actor) logWithConn(connID, s string) {
-	a.log(fmt.Sprintf("connID = %s: %s", connID, s))
+func (a *actor) warnWithConn(connID, format string, args ...interface{}) {
+	a.logger.WithFields(Fields{ConnIDField: connID}).Warnf(format, args...)
 }
 
 func (a *actor) Liveness() <-chan struct{} {
@@ -177,14 +663,22 @@ func (a *actor) IsRegistered() <-chan struct{} {
 
 func (a *actor) Kill() {
 	a.mtx.Lock()
-	defer a.mtx.Unlock()
+	if a.killed {
+		a.mtx.Unlock()
+		return
+	}
+	if a.recorder != nil {
+		a.recorder.Kill(a.ID)
+	}
+	a.killed = true
+	a.mtx.Unlock()
 
+	// goroutines of connections may wait for peers that ask for
+	// the Meta of the Actor, so they are stopped without the lock
 	conns := a.connectionMonitor.List()
 	for _, c := range conns {
-		a.Delete(c.ID, true)
+		a.detach(c.ID)
 	}
-
-	a.killed = true
 	close(a.killCh)
 }
 
@@ -195,16 +689,30 @@ func (a *actor) IsAlive() bool {
 	return !a.killed
 }
 
-func (a *actor) PrintState() {
-	a.mtx.Lock()
-	defer a.mtx.Unlock()
+func (a *actor) State() ActorState {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
 
-	fmt.Println("========================================")
-	fmt.Printf("%s:\n", a.ID)
-	defer fmt.Println("========================================")
+	rv := ActorState{
+		ID:            a.ID,
+		Class:         a.Class,
+		Node:          a.Node,
+		NetworkHolder: a.NetworkHolder,
+		Labels:        cloneLabels(a.Labels),
+		Alive:         !a.killed,
+		Connections:   []ConnectionState{},
+	}
+	select {
+	case <-a.regCh:
+		rv.Registered = true
+	default:
+	}
 
-	conns := a.connectionMonitor.List()
-	for _, c := range conns {
-		fmt.Printf("\tconnID = %s, State = %v\n", c.ID, c.State.String())
+	for _, c := range a.connectionMonitor.List() {
+		rv.Connections = append(rv.Connections, NewConnectionState(c))
 	}
+	sort.Slice(rv.Connections, func(i, j int) bool {
+		return rv.Connections[i].ID < rv.Connections[j].ID
+	})
+	return rv
 }
@@ -2,77 +2,494 @@ package sandbox
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Connection struct {
 	ID        string
 	LastActor string
+	// The first NetworkHolder downstream, see ForwardingEntry
+	Ingress Port
+	// Addresses allocated by the endpoint, see IPAM
+	IPContext IPContext
+
+	// Mechanism selected by the endpoint
+	Mechanism Mechanism
+	// Actors the request has passed
+	Segments []PathSegment     `json:",omitempty"`
+	Labels   map[string]string `json:",omitempty"`
 }
 
+// ConnectionWrapper is owned by the healer once it's monitored, others
+// read snapshots of it published by connectionMonitor
 type ConnectionWrapper struct {
 	Connection
 	State   HealState
 	request Request
+	// ID of the connection for goroutines of the wrapper,
+	// the healer replaces Connection
+	connID string
 
-	next           Actor
-	stopCh         chan struct{}
+	next   Actor
+	stopCh chan struct{}
+	// closed once the connection is stored, the healer can't find it before
+	storedCh       chan struct{}
 	resetWaitSrcCh chan struct{}
 	resetWaitDstCh chan struct{}
-	logFunc        func(connID, str string)
+	refreshCh      chan struct{}
+	logFunc        func(connID, format string, args ...interface{})
 	wg             sync.WaitGroup
+	destroyOnce    sync.Once
+
+	healer   Healer
+	waitDown func(peer Actor, stopCh <-chan struct{}) error
+
+	// event that caused the last transition and when
+	lastEvent   HealEvent
+	stateSince  time.Time
+	transitions int
+	closeErr    error
+
+	// index of the active path, see Request.Paths
+	path    int
+	standby []Path
+
+	// path that went down, it's closed after healing
+	broken  *Path
+	outages []Outage
+
+	// span of the heal in progress and of the current transition
+	healSpan *activeSpan
+	trace    SpanContext
+
+	// shared with snapshots, so they show timers that are pending now
+	timers *timerSet
+}
+
+type timerSet struct {
+	mtx       sync.Mutex
+	deadlines map[string]time.Time
+}
+
+// Timer is the pending timeout of the connection, see ConnectionWrapper.Timers
+type Timer struct {
+	Name     string    `json:"name" yaml:"name"`
+	Deadline time.Time `json:"deadline" yaml:"deadline"`
+}
+
+const (
+	WaitSrcTimer = "WaitSrc"
+	WaitDstTimer = "WaitDst"
+	ExpireTimer  = "Expire"
+)
+
+func (c *ConnectionWrapper) setTimer(name string, deadline time.Time) {
+	c.timers.mtx.Lock()
+	defer c.timers.mtx.Unlock()
+	c.timers.deadlines[name] = deadline
+}
+
+// clearTimer removes the timer unless it has been set again with another deadline
+func (c *ConnectionWrapper) clearTimer(name string, deadline time.Time) {
+	c.timers.mtx.Lock()
+	defer c.timers.mtx.Unlock()
+	if c.timers.deadlines[name].Equal(deadline) {
+		delete(c.timers.deadlines, name)
+	}
+}
+
+// Timers returns pending timeouts sorted by deadline
+func (c *ConnectionWrapper) Timers() []Timer {
+	c.timers.mtx.Lock()
+	defer c.timers.mtx.Unlock()
+	rv := make([]Timer, 0, len(c.timers.deadlines))
+	for name, deadline := range c.timers.deadlines {
+		rv = append(rv, Timer{Name: name, Deadline: deadline})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Deadline.Before(rv[j].Deadline)
+	})
+	return rv
+}
+
+// Path is one of the redundant paths of the connection, the next peer
+// knows it by PathID
+type Path struct {
+	Index int
+	Next  Actor
+}
+
+// PathID is the ID of the connection on the path, the first path
+// keeps the ID of the connection
+func PathID(connID string, index int) string {
+	if index == 0 {
+		return connID
+	}
+	return fmt.Sprintf("%s%s%d", connID, pathSeparator, index)
+}
+
+const pathSeparator = ".path-"
+
+// pathOwner returns the ID of the connection the PathID belongs to
+func pathOwner(pathID string) string {
+	if i := strings.LastIndex(pathID, pathSeparator); i >= 0 {
+		return pathID[:i]
+	}
+	return pathID
 }
 
-func NewConnectionWrapper(conn Connection, request Request, next Actor, logFunc func(connID, str string)) *ConnectionWrapper {
+// newPathIndex returns the index no path of the connection has used
+func (c *ConnectionWrapper) newPathIndex() int {
+	rv := c.path
+	for _, path := range c.standby {
+		if path.Index > rv {
+			rv = path.Index
+		}
+	}
+	return rv + 1
+}
+
+// Outage is the window when the connection had no usable path
+type Outage struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (o Outage) Duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
+
+// Outages returns windows between losing the next peer and healing
+func (c *ConnectionWrapper) Outages() []Outage {
+	return append([]Outage{}, c.outages...)
+}
+
+func pathRequest(request Request, index int) Request {
+	request.ConnectionID = PathID(request.ConnectionID, index)
+	request.Path = index
+	request.Paths = 0
+	return request
+}
+
+func NewConnectionWrapper(conn Connection, request Request, next Actor, logFunc func(connID, format string, args ...interface{})) *ConnectionWrapper {
 	return &ConnectionWrapper{
 		Connection: conn,
 		next:       next,
 		request:    request,
+		connID:     conn.ID,
 		stopCh:     make(chan struct{}),
+		storedCh:   make(chan struct{}),
+		refreshCh:  make(chan struct{}, 1),
 		logFunc:    logFunc,
 		State:      Ready,
+		stateSince: time.Now(),
+		timers:     &timerSet{deadlines: map[string]time.Time{}},
+	}
+}
+
+// snapshot copies the wrapper, it's called by the owner and the copy
+// is never changed, so it's safe to read from any goroutine
+func (c *ConnectionWrapper) snapshot() *ConnectionWrapper {
+	conn := c.Connection
+	conn.Segments = append(conn.Segments[:0:0], conn.Segments...)
+	conn.Labels = cloneLabels(conn.Labels)
+	conn.Mechanism = conn.Mechanism.Clone()
+	return &ConnectionWrapper{
+		Connection:  conn,
+		State:       c.State,
+		request:     c.request,
+		connID:      c.connID,
+		next:        c.next,
+		logFunc:     c.logFunc,
+		lastEvent:   c.lastEvent,
+		stateSince:  c.stateSince,
+		transitions: c.transitions,
+		closeErr:    c.closeErr,
+		path:        c.path,
+		standby:     append(c.standby[:0:0], c.standby...),
+		broken:      c.broken,
+		outages:     append(c.outages[:0:0], c.outages...),
+		timers:      c.timers,
 	}
 }
 
+func (c *ConnectionWrapper) String() string {
+	return fmt.Sprintf("{%s %v}", c.connID, c.State)
+}
+
+// Destroy stops goroutines of the connection, Kill and the healer
+// may destroy it concurrently
 func (c *ConnectionWrapper) Destroy() {
-	close(c.stopCh)
+	c.destroyOnce.Do(func() {
+		close(c.stopCh)
+	})
 	c.wg.Wait()
 }
 
-func (c *ConnectionWrapper) Monitor(healer Healer) {
+// Monitor emits DstDown and SrcDown when waitDown reports
+// that the corresponding peer is down
+func (c *ConnectionWrapper) Monitor(healer Healer, waitDown func(peer Actor, stopCh <-chan struct{}) error) {
+	c.healer = healer
+	c.waitDown = waitDown
+
 	if c.next != nil {
-		c.wg.Add(1)
-		go func() {
-			defer c.wg.Done()
+		c.watch(c.next, DstDown)
+	}
+	// a dead standby is dropped before it's needed for the failover
+	for _, path := range c.standby {
+		c.watch(path.Next, DstDown)
+	}
+	if c.request.From != nil {
+		c.watch(c.request.From, SrcDown)
+	}
+}
+
+// SetNext replaces the next peer, e.g. after the route is re-planned,
+// the previous one is supposed to be down already
+func (c *ConnectionWrapper) SetNext(next Actor) {
+	c.next = next
+	if c.healer != nil && next != nil {
+		c.watch(next, DstDown)
+	}
+}
+
+// SetFrom updates the source after the connection is requested again
+func (c *ConnectionWrapper) SetFrom(from Actor) {
+	if from == nil || c.request.From == from {
+		return
+	}
+	c.request.From = from
+	if c.healer != nil {
+		c.watch(from, SrcDown)
+	}
+}
 
-			err := waitDeath(c.next, c.stopCh)
-			if err == nil {
+// Standby returns paths that take over when the next peer is down
+func (c *ConnectionWrapper) Standby() []Path {
+	return append([]Path{}, c.standby...)
+}
+
+// ActivePath returns the index of the path in use
+func (c *ConnectionWrapper) ActivePath() int {
+	return c.path
+}
+
+// nextRequest is the request the next peer of the active path expects,
+// it asks to keep addresses of the connection
+func (c *ConnectionWrapper) nextRequest() Request {
+	request := pathRequest(c.request, c.path)
+	request.IPContext = c.Connection.IPContext
+	return request
+}
+
+// Refreshed postpones the expiration of the connection
+func (c *ConnectionWrapper) Refreshed() {
+	select {
+	case c.refreshCh <- struct{}{}:
+	default:
+	}
+}
+
+// Expire emits Expired unless the connection is refreshed within ttl
+func (c *ConnectionWrapper) Expire(ttl time.Duration) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		timer := time.NewTimer(ttl)
+		defer timer.Stop()
+		deadline := time.Now().Add(ttl)
+		c.setTimer(ExpireTimer, deadline)
+		defer func() {
+			c.clearTimer(ExpireTimer, deadline)
+		}()
+		for {
+			select {
+			case <-c.stopCh:
+				return
+			case <-c.refreshCh:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(ttl)
+				deadline = time.Now().Add(ttl)
+				c.setTimer(ExpireTimer, deadline)
+			case <-timer.C:
+				c.logFunc(c.connID, "not refreshed for %v", ttl)
+				c.emit(Expired)
 				return
 			}
-			c.logFunc(c.ID, "down")
-			healer.Emit(DstDown, c.ID)
-		}()
-	}
-	if c.request.From != nil {
-		c.wg.Add(1)
-		go func() {
-			defer c.wg.Done()
+		}
+	}()
+}
 
-			err := waitDeath(c.request.From, c.stopCh)
-			if err == nil {
+// Keepalive calls refresh with the ID of the connection every interval
+// until the connection is destroyed
+func (c *ConnectionWrapper) Keepalive(interval time.Duration, refresh func(connID string)) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopCh:
 				return
+			case <-ticker.C:
+				refresh(c.connID)
 			}
-			c.logFunc(c.ID, "down")
-			healer.Emit(SrcDown, c.ID)
-		}()
+		}
+	}()
+}
+
+// emit doesn't wait for the healer, so Destroy called
+// by the healer doesn't wait for this goroutine
+func (c *ConnectionWrapper) emit(event HealEvent) {
+	go func() {
+		select {
+		case <-c.storedCh:
+			c.healer.Emit(event, c.connID)
+		case <-c.stopCh:
+		}
+	}()
+}
+
+// stored lets events emitted by goroutines of the wrapper reach the healer
+func (c *ConnectionWrapper) stored() {
+	close(c.storedCh)
+}
+
+// SetUpstream updates the source side of the path after the connection
+// is requested again, segments end with the owner of the wrapper
+func (c *ConnectionWrapper) SetUpstream(segments []PathSegment) {
+	if len(segments) == 0 {
+		return
+	}
+	c.request.Segments = segments
+
+	self := segments[len(segments)-1].Name
+	downstream := []PathSegment{}
+	for i, s := range c.Connection.Segments {
+		if s.Name == self {
+			downstream = c.Connection.Segments[i+1:]
+			break
+		}
 	}
+	c.Connection.Segments = append(append([]PathSegment{}, segments...), downstream...)
 }
 
-func waitDeath(peer Actor, stopCh <-chan struct{}) error {
-	select {
-	case <-peer.Liveness():
-		return fmt.Errorf("peer %v is dead", peer.GetMeta().ID)
-	case <-stopCh:
-		return nil
+// Hops returns IDs of actors the connection traverses in order
+func (c *ConnectionWrapper) Hops() []string {
+	return c.Connection.Hops()
+}
+
+func (c Connection) Hops() []string {
+	rv := make([]string, 0, len(c.Segments))
+	for _, s := range c.Segments {
+		rv = append(rv, s.Name)
+	}
+	return rv
+}
+
+// PathDiff shows how the path of the connection has changed, e.g. by healing
+type PathDiff struct {
+	Kept    []string
+	Removed []string
+	Added   []string
+}
+
+func (d PathDiff) Changed() bool {
+	return len(d.Removed) != 0 || len(d.Added) != 0
+}
+
+func (d PathDiff) String() string {
+	return fmt.Sprintf("kept %v, removed %v, added %v", d.Kept, d.Removed, d.Added)
+}
+
+// ComparePaths returns actors that are in both paths, only before and only after
+func ComparePaths(before, after []string) PathDiff {
+	contains := func(path []string, id string) bool {
+		for _, p := range path {
+			if p == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	rv := PathDiff{}
+	for _, id := range before {
+		if contains(after, id) {
+			rv.Kept = append(rv.Kept, id)
+		} else {
+			rv.Removed = append(rv.Removed, id)
+		}
+	}
+	for _, id := range after {
+		if !contains(before, id) {
+			rv.Added = append(rv.Added, id)
+		}
+	}
+	return rv
+}
+
+func (c *ConnectionWrapper) watch(peer Actor, event HealEvent) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		err := c.waitDown(peer, c.stopCh)
+		if err == nil {
+			return
+		}
+		c.logFunc(c.connID, "down: %v", err)
+		c.emit(event)
+	}()
+}
+
+// CloseError lists hops that didn't acknowledge the close,
+// the rest of the route is closed anyway
+type CloseError struct {
+	ConnectionID string
+	// actor ID -> reason
+	Failed map[string]string
+}
+
+func newCloseError(connID, peerID string, err error) *CloseError {
+	rv := &CloseError{
+		ConnectionID: connID,
+		Failed:       map[string]string{},
+	}
+	rv.add(peerID, err)
+	return rv
+}
+
+// add records the failure of the peer, hops that failed
+// behind it are merged instead
+func (e *CloseError) add(peerID string, err error) {
+	if ce, ok := err.(*CloseError); ok {
+		for id, reason := range ce.Failed {
+			e.Failed[id] = reason
+		}
+	} else {
+		e.Failed[peerID] = err.Error()
+	}
+}
+
+func (e *CloseError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	reasons := []string{}
+	for _, id := range ids {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", id, e.Failed[id]))
 	}
+	return fmt.Sprintf("connection '%s' is partially closed: %s", e.ConnectionID, strings.Join(reasons, "; "))
 }
@@ -0,0 +1,118 @@
+package sandbox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Port is where packets of the connection enter the Actor
+type Port struct {
+	Actor        string
+	ConnectionID string
+}
+
+// ForwardingEntry is programmed by the NetworkHolder Actor for every
+// connection, packets are sent to Next or delivered locally if it's empty
+type ForwardingEntry struct {
+	ConnectionID string
+	Next         Port
+}
+
+// ForwardingEntry returns the entry of the connection,
+// actors that are not NetworkHolder don't forward packets
+func (a *actor) ForwardingEntry(connID string) (ForwardingEntry, bool) {
+	if !a.NetworkHolder || !a.IsAlive() {
+		return ForwardingEntry{}, false
+	}
+	cw, err := a.latest(connID)
+	if err != nil || cw.State == Closing {
+		return ForwardingEntry{}, false
+	}
+	if cw.next != nil && cw.Connection.Ingress.Actor == "" {
+		// the next peer didn't establish the connection
+		return ForwardingEntry{}, false
+	}
+	return ForwardingEntry{
+		ConnectionID: connID,
+		Next:         cw.Connection.Ingress,
+	}, true
+}
+
+// upstream returns the connection as the source sees it,
+// NetworkHolder receives packets of the connection itself
+func (a *actor) upstream(cw *ConnectionWrapper) Connection {
+	conn := cw.Connection
+	conn.Labels = cloneLabels(conn.Labels)
+	conn.Mechanism = conn.Mechanism.Clone()
+	if a.NetworkHolder {
+		conn.Ingress = Port{Actor: a.ID, ConnectionID: cw.ID}
+	}
+	for _, i := range a.interceptors {
+		i.Response(a.Meta.Clone(), &conn)
+	}
+	return conn
+}
+
+// maxProbeHops stops the probe if forwarding entries make a loop
+const maxProbeHops = 64
+
+type ProbeResult struct {
+	ConnectionID string
+	Delivered    bool
+	// Actors that forwarded the packet, the last one either
+	// delivered or dropped it
+	Hops      []string
+	DroppedAt string
+	Reason    string
+}
+
+func (r ProbeResult) String() string {
+	path := strings.Join(r.Hops, " → ")
+	if r.Delivered {
+		return fmt.Sprintf("connection '%s': delivered %s", r.ConnectionID, path)
+	}
+	return fmt.Sprintf("connection '%s': dropped at '%s' (%s) %s", r.ConnectionID, r.DroppedAt, r.Reason, path)
+}
+
+// Probe sends the synthetic packet of the connection from src following
+// forwarding entries, the packet is dropped by dead or unreachable actors
+// and actors that have no entry for the connection
+func Probe(router Router, src Actor, connID string) ProbeResult {
+	rv := ProbeResult{ConnectionID: connID}
+	drop := func(actorID, reason string) ProbeResult {
+		rv.DroppedAt = actorID
+		rv.Reason = reason
+		return rv
+	}
+
+	current, id := src, connID
+	for len(rv.Hops) < maxProbeHops {
+		meta := current.GetMeta()
+		rv.Hops = append(rv.Hops, meta.ID)
+		if !current.IsAlive() {
+			return drop(meta.ID, "actor is dead")
+		}
+		if router.IsFrozen(meta.Node) {
+			return drop(meta.ID, "node is frozen")
+		}
+
+		entry, ok := current.ForwardingEntry(id)
+		if !ok {
+			return drop(meta.ID, fmt.Sprintf("no forwarding entry for '%s'", id))
+		}
+		if entry.Next.Actor == "" {
+			rv.Delivered = true
+			return rv
+		}
+
+		next := router.FindActor(entry.Next.Actor)
+		if next == nil {
+			return drop(meta.ID, fmt.Sprintf("no actor '%s'", entry.Next.Actor))
+		}
+		if !router.Reachable(meta.Node, next.GetMeta().Node) {
+			return drop(meta.ID, fmt.Sprintf("actor '%s' is unreachable", entry.Next.Actor))
+		}
+		current, id = next, entry.Next.ConnectionID
+	}
+	return drop(rv.Hops[len(rv.Hops)-1], "forwarding loop")
+}
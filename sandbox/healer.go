@@ -20,6 +20,8 @@ const (
 const (
 	WaitDstTimeout = 5 * time.Second
 	WaitSrcTimeout = 2 * WaitDstTimeout
+	// healRetryDelay is the pause between failed heals of the connection
+	healRetryDelay = 100 * time.Millisecond
 )
 
 func (h HealState) String() string {
@@ -43,6 +45,16 @@ func (h HealState) String() string {
 	}
 }
 
+// ParseHealState is the reverse of HealState.String
+func ParseHealState(s string) (HealState, error) {
+	for h := Unknown; h <= Closing; h++ {
+		if h.String() == s {
+			return h, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown heal State '%s'", s)
+}
+
 type HealEvent int
 
 const (
@@ -51,6 +63,12 @@ const (
 	DstDown
 	DstUp
 	Timeout
+	// Close is requested by the source
+	Close
+	// DstClosed is received when the next peer closed the connection
+	DstClosed
+	// Expired is received when the source didn't refresh the connection in time
+	Expired
 )
 
 func (h HealEvent) String() string {
@@ -65,6 +83,12 @@ func (h HealEvent) String() string {
 		return "DstUp"
 	case Timeout:
 		return "Timeout"
+	case Close:
+		return "Close"
+	case DstClosed:
+		return "DstClosed"
+	case Expired:
+		return "Expired"
 	default:
 		panic("unknown event")
 	}
@@ -72,50 +96,137 @@ func (h HealEvent) String() string {
 
 type Healer interface {
 	Emit(event HealEvent, connId string) func()
+	// Requested emits SrcUp for the connection requested again,
+	// the request is accepted by the Actor already
+	Requested(request Request) func()
 	Serve(stopCh <-chan struct{})
 }
 
+// Forwarder is the Actor that owns the healer,
+// it is used to repair and close the connection
+type Forwarder interface {
+	Actor
+	SelectNext(request Request) (Actor, error)
+	RequestNext(request Request, next Actor) (Connection, error)
+	Refresh(cw *ConnectionWrapper)
+}
+
 type CloseHealer struct {
+	// build the new path before closing the old one while healing
+	makeBeforeBreak bool
+	// don't ask the endpoint to keep addresses while healing
+	reallocate bool
+	metrics    *Metrics
+	tracer     tracer
+
 	router      Router
 	connections ConnectionDomain
+	forwarder   Forwarder
 	transitions map[HealState]map[HealEvent]HealState
 	handlers    map[HealState]func(cd *ConnectionWrapper)
-	logFunc     func(string, string)
-	eventCh     chan struct {
-		event  HealEvent
-		connID string
-		joinCh chan struct{}
+	logger      Logger
+	doneCh      chan struct{}
+	eventCh     chan healerEvent
+}
+
+// healerEvent changes the connection with update, if any, before the transition
+type healerEvent struct {
+	event  HealEvent
+	connID string
+	joinCh chan struct{}
+	update func(cw *ConnectionWrapper)
+}
+
+// HealerOption configures the Healer created by NewCloseHealer
+type HealerOption func(c *CloseHealer)
+
+// MakeBeforeBreak makes Healing establish the replacement segment with a new
+// PathID and close the old segment only after the switch
+func MakeBeforeBreak() HealerOption {
+	return func(c *CloseHealer) {
+		c.makeBeforeBreak = true
+	}
+}
+
+// ReallocateAddresses makes Healing request the next peer without
+// addresses of the connection, so the endpoint allocates new ones
+func ReallocateAddresses() HealerOption {
+	return func(c *CloseHealer) {
+		c.reallocate = true
+	}
+}
+
+func WithHealerMetrics(metrics *Metrics) HealerOption {
+	return func(c *CloseHealer) {
+		c.metrics = metrics
 	}
 }
 
-func NewCloseHealer(router Router, connections ConnectionDomain, logFunc func(string, string)) Healer {
+func NewCloseHealer(router Router, connections ConnectionDomain, forwarder Forwarder, logger Logger, opts ...HealerOption) Healer {
 	rv := &CloseHealer{
 		router:      router,
 		connections: connections,
-		logFunc:     logFunc,
+		forwarder:   forwarder,
+		logger:      logger,
 		transitions: map[HealState]map[HealEvent]HealState{
 			Ready: {
-				SrcDown: WaitSrc,
-				DstDown: WaitDst,
-				SrcUp:   Ready,
+				SrcDown:   WaitSrc,
+				DstDown:   WaitDst,
+				SrcUp:     Ready,
+				Close:     Closing,
+				DstClosed: Closing,
+				Expired:   Closing,
 			},
+			// both peers are down after correlated failure,
+			// there is nothing to heal
 			WaitSrc: {
-				Timeout: Closing,
-				SrcUp:   Healing,
+				Timeout:   Closing,
+				SrcUp:     Healing,
+				SrcDown:   WaitSrc,
+				DstDown:   Closing,
+				Close:     Closing,
+				DstClosed: Closing,
+				Expired:   Closing,
 			},
+			// refresh can't pass the dead destination, so
+			// 'SrcUp' keeps waiting for it
 			WaitDst: {
-				Timeout: Closing,
-				DstUp:   Healing,
+				Timeout:   Closing,
+				DstUp:     Healing,
+				DstDown:   WaitDst,
+				SrcDown:   Closing,
+				SrcUp:     WaitDst,
+				Close:     Closing,
+				DstClosed: Closing,
+				Expired:   Closing,
 			},
+			// the timer may fire before Healing stops it, the
+			// peers may fail again while the next one is requested
 			Healing: {
-				DstUp: Ready,
+				DstUp:     Ready,
+				SrcUp:     Healing,
+				SrcDown:   WaitSrc,
+				DstDown:   WaitDst,
+				Timeout:   Healing,
+				Close:     Closing,
+				DstClosed: Closing,
+				Expired:   Closing,
+			},
+			// the connection is deleted already, late events change nothing
+			Closing: {
+				SrcDown:   Closing,
+				SrcUp:     Closing,
+				DstDown:   Closing,
+				DstUp:     Closing,
+				Timeout:   Closing,
+				Close:     Closing,
+				DstClosed: Closing,
+				Expired:   Closing,
 			},
 		},
-		eventCh: make(chan struct {
-			event  HealEvent
-			connID string
-			joinCh chan struct{}
-		}, 1),
+		eventCh: make(chan healerEvent, 1),
+		doneCh:  make(chan struct{}),
+		metrics: DefaultMetrics,
 	}
 
 	rv.handlers = map[HealState]func(cd *ConnectionWrapper){
@@ -125,28 +236,66 @@ func NewCloseHealer(router Router, connections ConnectionDomain, logFunc func(st
 		Healing: rv.Healing,
 	}
 
+	for _, o := range opts {
+		o(rv)
+	}
+
 	return rv
 }
 
+// Emit doesn't block once the healer is stopped, the event is dropped
 func (c *CloseHealer) Emit(event HealEvent, connID string) func() {
-	c.logFunc(connID, fmt.Sprintf("emit event: %v", event))
+	return c.emit(event, connID, nil)
+}
+
+func (c *CloseHealer) Requested(request Request) func() {
+	return c.emit(SrcUp, request.ConnectionID, func(cw *ConnectionWrapper) {
+		cw.SetFrom(request.From)
+		cw.SetUpstream(request.Segments)
+		// refreshes pass what interceptors and negotiation left
+		cw.request.Labels = request.Labels
+		cw.request.MechanismPreferences = request.MechanismPreferences
+		cw.Refreshed()
+	})
+}
+
+func (c *CloseHealer) emit(event HealEvent, connID string, update func(cw *ConnectionWrapper)) func() {
+	c.logFunc(connID, "emit event: %v", event)
 	joinCh := make(chan struct{})
 
-	c.eventCh <- struct {
-		event  HealEvent
-		connID string
-		joinCh chan struct{}
-	}{event: event, connID: connID, joinCh: joinCh}
+	select {
+	case c.eventCh <- healerEvent{event: event, connID: connID, joinCh: joinCh, update: update}:
+	case <-c.doneCh:
+		c.logFunc(connID, "healer is stopped, event %v dropped", event)
+		return func() {}
+	}
 
-	return func() { <-joinCh }
+	return func() {
+		select {
+		case <-joinCh:
+		case <-c.doneCh:
+		}
+	}
+}
+
+func (c *CloseHealer) logFunc(connID, format string, args ...interface{}) {
+	c.logger.WithFields(Fields{ConnIDField: connID}).Infof(format, args...)
+}
+
+func (c *CloseHealer) warnFunc(connID, format string, args ...interface{}) {
+	c.logger.WithFields(Fields{ConnIDField: connID}).Warnf(format, args...)
 }
 
 func (c *CloseHealer) WaitSrc(cw *ConnectionWrapper) {
 	c.logFunc(cw.ID, "handler for 'WaitSrc' State")
-	cw.resetWaitSrcCh = make(chan struct{})
+	resetCh := make(chan struct{})
+	cw.resetWaitSrcCh = resetCh
+	deadline := time.Now().Add(WaitSrcTimeout)
+	cw.setTimer(WaitSrcTimer, deadline)
 	go func() {
+		defer cw.clearTimer(WaitSrcTimer, deadline)
 		select {
-		case <-cw.resetWaitSrcCh:
+		case <-resetCh:
 			return
 		case <-time.After(WaitSrcTimeout):
 			c.Emit(Timeout, cw.ID)
@@ -156,61 +305,231 @@ func (c *CloseHealer) WaitSrc(cw *ConnectionWrapper) {
 
 func (c *CloseHealer) WaitDst(cw *ConnectionWrapper) {
 	c.logFunc(cw.ID, "handler for 'WaitDst' State")
-	cw.resetWaitDstCh = make(chan struct{})
+	if cw.broken == nil {
+		cw.broken = &Path{Index: cw.path, Next: cw.next}
+		cw.outages = append(cw.outages, Outage{Start: time.Now()})
+	}
+
+	// failed heals return here, the deadline doesn't move with them
+	deadline := cw.outages[len(cw.outages)-1].Start.Add(WaitDstTimeout)
+	if !time.Now().Before(deadline) {
+		c.logFunc(cw.ID, "not healed within %v", WaitDstTimeout)
+		go c.Emit(Timeout, cw.ID)
+		return
+	}
+	resetCh := make(chan struct{})
+	cw.resetWaitDstCh = resetCh
+	cw.setTimer(WaitDstTimer, deadline)
 	go func() {
+		defer cw.clearTimer(WaitDstTimer, deadline)
 		select {
-		case <-cw.resetWaitDstCh:
+		case <-resetCh:
 			return
-		case <-time.After(WaitDstTimeout):
+		case <-time.After(time.Until(deadline)):
 			c.Emit(Timeout, cw.ID)
 		}
 	}()
+
+	if cw.request.Dst != "" && cw.request.From == nil {
+		c.replan(cw)
+	}
 }
 
+// replan computes the new route on the first hop of the connection
+// and switches to the new next peer, Healing requests it
+func (c *CloseHealer) replan(cw *ConnectionWrapper) {
+	route, err := c.router.PlanRoute(cw.request.Src, cw.request.Dst)
+	if err != nil {
+		c.warnFunc(cw.ID, "failed to re-plan the route: %v", err)
+		return
+	}
+
+	request := cw.request
+	request.Route = route
+	next, err := c.forwarder.SelectNext(request)
+	if err != nil {
+		c.warnFunc(cw.ID, "failed to re-plan the route: %v", err)
+		return
+	}
+
+	c.logFunc(cw.ID, "route re-planned: %v", route)
+	cw.request = request
+	cw.SetNext(next)
+	c.connections.Update(cw)
+
+	go c.Emit(DstUp, cw.ID)
+}
+
+// Closing closes the connection downstream and waits for the acknowledgement,
+// unless it's closed there already. The source is notified asynchronously
+// unless it has requested the close itself
 func (c *CloseHealer) Closing(cw *ConnectionWrapper) {
 	c.logFunc(cw.ID, "handler for 'Closing' State")
-	if cw.next != nil {
-		cw.next.Close(cw.ID)
+	stopTimers(cw)
+
+	var closeErr *CloseError
+	closePath := func(path Path) {
+		err := path.Next.Close(PathID(cw.ID, path.Index))
+		if err == nil {
+			return
+		}
+		c.warnFunc(cw.ID, "failed to close path %d downstream: %v", path.Index, err)
+		if closeErr == nil {
+			closeErr = newCloseError(cw.ID, path.Next.GetMeta().ID, err)
+		} else {
+			closeErr.add(path.Next.GetMeta().ID, err)
+		}
+	}
+
+	if cw.next != nil && cw.lastEvent != DstClosed {
+		closePath(Path{Index: cw.path, Next: cw.next})
+	}
+	for _, path := range cw.standby {
+		closePath(path)
+	}
+	cw.closeErr = nil
+	if closeErr != nil {
+		cw.closeErr = closeErr
 	}
 	c.connections.Delete(cw.ID, false)
+
+	if from := cw.request.From; from != nil && cw.lastEvent != Close {
+		go from.NotifyClosed(cw.ID, c.forwarder)
+	}
 }
 
 func (c *CloseHealer) Healing(cw *ConnectionWrapper) {
 	c.logFunc(cw.ID, "handler for 'Healing' State")
-	if cw.resetWaitSrcCh != nil {
-		close(cw.resetWaitSrcCh)
-	}
+	stopTimers(cw)
 
 	// TODO: some logic where we should decide do we need to 'next' sandbox
 
-	if cw.next == nil {
+	if cw.next == nil && cw.request.Current == len(cw.request.Route)-1 {
+		// the last hop has nothing to heal downstream, Serve can't
+		// wait for its own channel
+		go c.Emit(DstUp, cw.ID)
+		return
+	}
+
+	var err error
+	switch {
+	case cw.next == nil:
+		// e.g. the recovered connection whose next peer is gone
+		err = fmt.Errorf("no next peer")
+	case c.makeBeforeBreak:
+		err = c.switchPath(cw)
+	default:
+		err = c.requestPath(cw)
+	}
+	if err != nil {
+		// the next peer isn't usable yet, WaitDst retries until its deadline
+		c.warnFunc(cw.ID, "error during 'Healing' State: %v", err)
+		go func() {
+			<-time.After(healRetryDelay)
+			c.Emit(DstDown, cw.ID)
+		}()
 		return
 	}
+	c.healed(cw)
+	c.connections.Update(cw)
 
-	conn, err := cw.next.Request(cw.request)
+	go c.Emit(DstUp, cw.ID)
+}
+
+// requestPath requests the next peer with the PathID of the connection
+func (c *CloseHealer) requestPath(cw *ConnectionWrapper) error {
+	conn, err := c.forwarder.RequestNext(c.healRequest(cw, cw.path), cw.next)
 	if err != nil {
-		c.logFunc(cw.ID, fmt.Sprintf("error during 'Healing' State: %v", err))
+		return err
 	}
 
+	conn.ID = cw.ID
 	cw.Connection = conn
-	c.connections.Update(cw)
+	return nil
+}
+
+// switchPath requests the next peer with a new PathID, the old segment
+// is closed when the new one is ready. The old segment is kept if the
+// new one fails
+func (c *CloseHealer) switchPath(cw *ConnectionWrapper) error {
+	old := Path{Index: cw.path, Next: cw.next}
+	if cw.broken != nil {
+		old = *cw.broken
+	}
+
+	index := cw.newPathIndex()
+	conn, err := c.forwarder.RequestNext(c.healRequest(cw, index), cw.next)
+	if err != nil {
+		return fmt.Errorf("failed to establish path %d, keep path %d: %v", index, old.Index, err)
+	}
 
-	c.Emit(DstUp, cw.ID)
+	c.logFunc(cw.ID, "switch from path %d to path %d", old.Index, index)
+	conn.ID = cw.ID
+	cw.Connection = conn
+	cw.path = index
+
+	if old.Next == nil {
+		return nil
+	}
+	if err := old.Next.Close(PathID(cw.ID, old.Index)); err != nil {
+		c.warnFunc(cw.ID, "failed to close path %d: %v", old.Index, err)
+	}
+	return nil
+}
+
+// healRequest is the request of the path sent to the next peer while healing
+func (c *CloseHealer) healRequest(cw *ConnectionWrapper, index int) Request {
+	request := pathRequest(cw.request, index)
+	if !c.reallocate {
+		request.IPContext = cw.Connection.IPContext
+	}
+	if cw.trace.IsValid() {
+		request.Trace = cw.trace
+	}
+	return request
+}
+
+// healed closes the outage that started when the next peer was lost
+func (c *CloseHealer) healed(cw *ConnectionWrapper) {
+	if cw.broken == nil {
+		return
+	}
+	cw.broken = nil
+
+	outage := &cw.outages[len(cw.outages)-1]
+	outage.End = time.Now()
+	c.logFunc(cw.ID, "no usable path for %v", outage.Duration())
+}
+
+func stopTimers(cw *ConnectionWrapper) {
+	if cw.resetWaitSrcCh != nil {
+		close(cw.resetWaitSrcCh)
+		cw.resetWaitSrcCh = nil
+	}
+	if cw.resetWaitDstCh != nil {
+		close(cw.resetWaitDstCh)
+		cw.resetWaitDstCh = nil
+	}
 }
 
 func (c *CloseHealer) Serve(stopCh <-chan struct{}) {
+	defer close(c.doneCh)
 	for {
 		select {
 		case <-stopCh:
 			return
 		case event := <-c.eventCh:
-			c.logFunc(event.connID, fmt.Sprintf("new event %v received", event.event))
+			c.logFunc(event.connID, "new event %v received", event.event)
 			cd, err := c.connections.Get(event.connID)
 			if err != nil {
-				c.logFunc(event.connID, err.Error())
+				c.logFunc(event.connID, "%v", err)
+				close(event.joinCh)
 				continue
 			}
 
+			if event.update != nil {
+				event.update(cd)
+			}
 			c.transit(cd, event.event)
 			close(event.joinCh)
 		}
@@ -218,8 +537,46 @@ func (c *CloseHealer) Serve(stopCh <-chan struct{}) {
 }
 
 func (c *CloseHealer) transit(cw *ConnectionWrapper, event HealEvent) {
-	newState := c.nextState(cw.State, event)
-	c.logFunc(cw.ID, fmt.Sprintf("change State from %v to %v, event - %v", cw.State, newState, event))
+	span := c.startTransition(cw, event)
+	defer c.endTransition(cw, span)
+
+	if cw.State == Ready && event == DstDown && c.dropStandby(cw) {
+		c.connections.Update(cw)
+		return
+	}
+	if cw.State == Ready && event == DstDown && c.failover(cw) {
+		cw.lastEvent = event
+		cw.transitions++
+		c.metrics.HealTransitions.Add(1, Ready.String(), Ready.String(), event.String())
+		c.metrics.HealOutcomes.Add(1, FailoverOutcome)
+		c.connections.Update(cw)
+		return
+	}
+
+	newState, ok := c.nextState(cw.State, event)
+	if !ok {
+		c.warnFunc(cw.ID, "no transition for State %v with event %v, event dropped", cw.State, event)
+		return
+	}
+	c.logger.WithFields(Fields{
+		ConnIDField: cw.ID,
+		StateField:  newState.String(),
+		EventField:  event.String(),
+	}).Infof("change State from %v to %v, event - %v", cw.State, newState, event)
+	c.metrics.HealTransitions.Add(1, cw.State.String(), newState.String(), event.String())
+	cw.lastEvent = event
+	cw.transitions++
+	if cw.State == Ready && event == SrcUp {
+		// it's a refresh, healing has requested the next hop already
+		c.forwarder.Refresh(cw)
+	}
+	if newState == cw.State {
+		// handler has been already called, e.g. timer is running
+		c.connections.Update(cw)
+		return
+	}
+
+	c.observe(cw, newState)
 	cw.State = newState
 	c.connections.Update(cw)
 	h, ok := c.handlers[newState]
@@ -228,16 +585,108 @@ func (c *CloseHealer) transit(cw *ConnectionWrapper, event HealEvent) {
 	}
 }
 
-func (c *CloseHealer) nextState(current HealState, event HealEvent) HealState {
-	events, ok := c.transitions[current]
-	if !ok {
-		panic(fmt.Sprintf("unknown transition for State %v with event %v", current, event))
+// isDown reports whether the peer is dead or unreachable
+func (c *CloseHealer) isDown(peer Actor) bool {
+	return !peer.IsAlive() || !c.router.Reachable(c.forwarder.GetMeta().Node, peer.GetMeta().Node)
+}
+
+// dropStandby removes standby paths whose next peer is down, DstDown
+// of the ready connection came from them if the next peer is still up
+func (c *CloseHealer) dropStandby(cw *ConnectionWrapper) bool {
+	if cw.next == nil || c.isDown(cw.next) {
+		return false
+	}
+	standby := cw.standby[:0:0]
+	for _, path := range cw.standby {
+		if c.isDown(path.Next) {
+			c.logFunc(cw.ID, "standby path %d is down, dropped", path.Index)
+			continue
+		}
+		standby = append(standby, path)
 	}
+	cw.standby = standby
+	return true
+}
 
-	newState, ok := events[event]
-	if !ok {
-		panic(fmt.Sprintf("unknown transition for State %v with event %v", current, event))
+// failover switches to the first standby path that is still up,
+// the connection stays 'Ready'
+func (c *CloseHealer) failover(cw *ConnectionWrapper) bool {
+	for len(cw.standby) > 0 {
+		path := cw.standby[0]
+		cw.standby = cw.standby[1:]
+
+		if c.isDown(path.Next) {
+			c.logFunc(cw.ID, "standby path %d is down", path.Index)
+			continue
+		}
+		// re-request restores the path if it's closed downstream
+		conn, err := c.forwarder.RequestNext(c.healRequest(cw, path.Index), path.Next)
+		if err != nil {
+			c.warnFunc(cw.ID, "standby path %d failed: %v", path.Index, err)
+			continue
+		}
+
+		c.logFunc(cw.ID, "failover to path %d", path.Index)
+		conn.ID = cw.ID
+		cw.Connection = conn
+		cw.path = path.Index
+		// the standby peer is watched already, see Monitor
+		cw.next = path.Next
+		return true
 	}
+	return false
+}
+
+// startTransition creates the span of the transition, a failure of the peer
+// starts the new trace of the heal, transitions until the connection is ready
+// or closed are its children. Requests sent by handlers are linked to the span
+func (c *CloseHealer) startTransition(cw *ConnectionWrapper, event HealEvent) *activeSpan {
+	actorID := c.forwarder.GetMeta().ID
+	if cw.healSpan == nil && (event == SrcDown || event == DstDown) {
+		cw.healSpan = c.tracer.start("heal", actorID, cw.ID, SpanContext{})
+		cw.healSpan.SetAttribute("cause", event.String())
+	}
+
+	parent := cw.request.Trace
+	if cw.healSpan != nil {
+		parent = cw.healSpan.Context()
+	}
+	span := c.tracer.start("transition", actorID, cw.ID, parent)
+	span.SetAttribute("from", cw.State.String())
+	span.SetAttribute("event", event.String())
+	cw.trace = span.Context()
+	return span
+}
+
+func (c *CloseHealer) endTransition(cw *ConnectionWrapper, span *activeSpan) {
+	span.SetAttribute("to", cw.State.String())
+	span.End()
+	cw.trace = SpanContext{}
+
+	if cw.healSpan != nil && (cw.State == Ready || cw.State == Closing) {
+		cw.healSpan.SetAttribute("outcome", cw.State.String())
+		cw.healSpan.End()
+		cw.healSpan = nil
+	}
+}
+
+// observe records how long the connection was healing and how it ended
+func (c *CloseHealer) observe(cw *ConnectionWrapper, newState HealState) {
+	switch cw.State {
+	case WaitSrc, WaitDst, Healing:
+		c.metrics.HealStateDuration.Observe(time.Since(cw.stateSince).Seconds(), cw.State.String())
+		switch newState {
+		case Ready:
+			c.metrics.HealOutcomes.Add(1, HealedOutcome)
+		case Closing:
+			c.metrics.HealOutcomes.Add(1, ClosedOutcome)
+		}
+	}
+	cw.stateSince = time.Now()
+}
 
-	return newState
+// nextState returns false if the event is unexpected in the current State
+func (c *CloseHealer) nextState(current HealState, event HealEvent) (HealState, bool) {
+	newState, ok := c.transitions[current][event]
+	return newState, ok
 }
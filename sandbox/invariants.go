@@ -0,0 +1,452 @@
+package sandbox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReadyPathGrace lets the hop wait for the replacement
+	// of the dead peer before the broken path is reported
+	DefaultReadyPathGrace = WaitDstTimeout + time.Second
+	// DefaultDeletePropagation is how long the Delete may take to reach the next hop
+	DefaultDeletePropagation = time.Second
+
+	// checkInterval is how often invariants are evaluated without events,
+	// so conditions that are broken for too long are reported in time
+	checkInterval = 50 * time.Millisecond
+	// maxHistory is how many entries of the history are kept
+	maxHistory = 1000
+)
+
+// Invariant is the property of the cluster that must hold after every event,
+// invariants may keep state between checks, so they are not shared by checkers
+type Invariant interface {
+	Name() string
+	// Check returns violations of the view, Invariant, At and History
+	// are filled by the checker. The view must not be modified
+	Check(view ClusterView, now time.Time) []Violation
+}
+
+// ClusterView is what the checker has observed so far, keyed by actor ID
+type ClusterView map[string]*ActorView
+
+type ActorView struct {
+	ID    string
+	Alive bool
+	// connections of the actor by ID
+	Connections map[string]ConnectionState
+	// the last state of deleted connections by ID
+	Deleted map[string]DeletedConnection
+}
+
+type DeletedConnection struct {
+	ConnectionState
+	At time.Time
+}
+
+// HistoryEntry is one connection of the observed event
+// or the kill of the actor
+type HistoryEntry struct {
+	At           time.Time
+	Actor        string
+	Event        string
+	ConnectionID string
+	State        string
+}
+
+func (e HistoryEntry) String() string {
+	if e.ConnectionID == "" {
+		return fmt.Sprintf("%s %-20s %s", e.At.Format("15:04:05.000"), e.Actor, e.Event)
+	}
+	return fmt.Sprintf("%s %-20s %s %s State = %s", e.At.Format("15:04:05.000"), e.Actor, e.Event, e.ConnectionID, e.State)
+}
+
+type Violation struct {
+	Invariant    string
+	Actor        string
+	ConnectionID string
+	Message      string
+	At           time.Time
+	// events of the connection and kills that led to the violation
+	History []HistoryEntry
+}
+
+func (v Violation) String() string {
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("invariant %s is violated on %s", v.Invariant, v.Actor))
+	if v.ConnectionID != "" {
+		sb.WriteString(fmt.Sprintf(", connection %s", v.ConnectionID))
+	}
+	sb.WriteString(fmt.Sprintf(": %s\nhistory:\n", v.Message))
+	for _, e := range v.History {
+		sb.WriteString(fmt.Sprintf("\t%v\n", e))
+	}
+	return sb.String()
+}
+
+// InvariantChecker evaluates invariants on every ConnectionEvent of
+// watched actors and periodically in between
+type InvariantChecker interface {
+	// Watch observes events of the Actor until stopCh is closed
+	Watch(actor Actor, stopCh <-chan struct{})
+	Observe(actorID string, event ConnectionEvent)
+	// Check evaluates invariants without new events
+	Check()
+	Violations() []Violation
+}
+
+type invariantChecker struct {
+	mtx        sync.Mutex
+	invariants []Invariant
+	actors     map[string]Actor
+	view       ClusterView
+	history    []HistoryEntry
+	reported   map[string]bool
+	violations []Violation
+}
+
+func NewInvariantChecker(invariants ...Invariant) InvariantChecker {
+	return &invariantChecker{
+		invariants: invariants,
+		actors:     map[string]Actor{},
+		view:       ClusterView{},
+		reported:   map[string]bool{},
+	}
+}
+
+// DefaultInvariants returns new instances of the built-in invariants
+func DefaultInvariants() []Invariant {
+	return []Invariant{
+		ReadyPath(DefaultReadyPathGrace),
+		NoConnectionsOnDeadActor(),
+		DeletePropagates(DefaultDeletePropagation),
+	}
+}
+
+func (c *invariantChecker) Watch(actor Actor, stopCh <-chan struct{}) {
+	actorID := actor.GetMeta().ID
+	monitor := actor.Monitor()
+
+	c.mtx.Lock()
+	c.actors[actorID] = actor
+	c.actorView(actorID).Alive = actor.IsAlive()
+	c.mtx.Unlock()
+
+	go func() {
+		defer actor.Unsubscribe(monitor)
+
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		liveness := actor.Liveness()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-liveness:
+				liveness = nil
+				c.killed(actorID)
+			case event := <-monitor:
+				c.Observe(actorID, event)
+			case <-ticker.C:
+				c.Check()
+			}
+		}
+	}()
+}
+
+func (c *invariantChecker) Observe(actorID string, event ConnectionEvent) {
+	now := time.Now()
+	states := make([]ConnectionState, 0, len(event.Connections))
+	for _, cw := range event.Connections {
+		states = append(states, NewConnectionState(cw))
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ID < states[j].ID
+	})
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	view := c.actorView(actorID)
+	if event.EventType == InitialTransfer {
+		view.Connections = map[string]ConnectionState{}
+	}
+	for _, s := range states {
+		c.remember(HistoryEntry{
+			At:           now,
+			Actor:        actorID,
+			Event:        event.EventType.String(),
+			ConnectionID: s.ID,
+			State:        s.State,
+		})
+		if event.EventType == Delete {
+			delete(view.Connections, s.ID)
+			view.Deleted[s.ID] = DeletedConnection{ConnectionState: s, At: now}
+			continue
+		}
+		view.Connections[s.ID] = s
+		delete(view.Deleted, s.ID)
+	}
+
+	if !view.Alive {
+		// the monitor of the dead actor may still deliver
+		// events sent before the kill, the actor itself is the truth
+		c.refresh(actorID)
+	}
+	c.checkLocked(now)
+}
+
+func (c *invariantChecker) Check() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.checkLocked(time.Now())
+}
+
+func (c *invariantChecker) Violations() []Violation {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return append([]Violation{}, c.violations...)
+}
+
+func (c *invariantChecker) killed(actorID string) {
+	now := time.Now()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.actorView(actorID).Alive = false
+	c.remember(HistoryEntry{At: now, Actor: actorID, Event: "Killed"})
+	c.refresh(actorID)
+	c.checkLocked(now)
+}
+
+// refresh replaces connections of the view with the ones the actor has
+func (c *invariantChecker) refresh(actorID string) {
+	view := c.actorView(actorID)
+	view.Connections = map[string]ConnectionState{}
+	for _, s := range c.actors[actorID].State().Connections {
+		view.Connections[s.ID] = s
+	}
+}
+
+func (c *invariantChecker) actorView(actorID string) *ActorView {
+	view, ok := c.view[actorID]
+	if !ok {
+		view = &ActorView{
+			ID:          actorID,
+			Alive:       true,
+			Connections: map[string]ConnectionState{},
+			Deleted:     map[string]DeletedConnection{},
+		}
+		c.view[actorID] = view
+	}
+	return view
+}
+
+func (c *invariantChecker) remember(e HistoryEntry) {
+	c.history = append(c.history, e)
+	if len(c.history) > maxHistory {
+		c.history = c.history[len(c.history)-maxHistory:]
+	}
+}
+
+// checkLocked reports every violation once per invariant, actor and connection
+// while it lasts, the violation that clears and comes back is reported again
+func (c *invariantChecker) checkLocked(now time.Time) {
+	broken := map[string]bool{}
+	for _, inv := range c.invariants {
+		for _, v := range inv.Check(c.view, now) {
+			key := fmt.Sprintf("%s/%s/%s", inv.Name(), v.Actor, v.ConnectionID)
+			broken[key] = true
+			if c.reported[key] {
+				continue
+			}
+			c.reported[key] = true
+
+			v.Invariant = inv.Name()
+			v.At = now
+			v.History = c.historyOf(v.ConnectionID)
+			c.violations = append(c.violations, v)
+		}
+	}
+	for key := range c.reported {
+		if !broken[key] {
+			delete(c.reported, key)
+		}
+	}
+}
+
+// historyOf returns entries of all paths of the connection and kills
+func (c *invariantChecker) historyOf(connID string) []HistoryEntry {
+	rv := []HistoryEntry{}
+	for _, e := range c.history {
+		if connID == "" || e.ConnectionID == "" || pathOwner(e.ConnectionID) == pathOwner(connID) {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+type readyPath struct {
+	grace time.Duration
+	// actor ID/connection ID of heads -> since when their path is broken
+	broken map[string]time.Time
+}
+
+// ReadyPath checks that the connection in Ready on the first hop is
+// Ready on every hop of its active path, the path may be broken for grace
+func ReadyPath(grace time.Duration) Invariant {
+	return &readyPath{
+		grace:  grace,
+		broken: map[string]time.Time{},
+	}
+}
+
+func (r *readyPath) Name() string {
+	return "ready-path"
+}
+
+func (r *readyPath) Check(view ClusterView, now time.Time) []Violation {
+	rv := []Violation{}
+	broken := map[string]time.Time{}
+	for _, a := range view {
+		if !a.Alive {
+			continue
+		}
+		for _, head := range a.Connections {
+			if head.FromID != "" || head.State != Ready.String() {
+				continue
+			}
+			msg := brokenHop(view, head)
+			if msg == "" {
+				continue
+			}
+
+			key := a.ID + "/" + head.ID
+			since, ok := r.broken[key]
+			if !ok {
+				since = now
+			}
+			broken[key] = since
+			if now.Sub(since) > r.grace {
+				rv = append(rv, Violation{
+					Actor:        a.ID,
+					ConnectionID: head.ID,
+					Message:      fmt.Sprintf("connection is Ready for %v, but %s", now.Sub(since).Round(time.Millisecond), msg),
+				})
+			}
+		}
+	}
+	r.broken = broken
+	return rv
+}
+
+// brokenHop follows the active path of the connection and describes
+// the first hop that is not Ready, hops that are not watched end the path
+func brokenHop(view ClusterView, conn ConnectionState) string {
+	for i := 0; i < len(view) && conn.NextID != ""; i++ {
+		next, ok := view[conn.NextID]
+		if !ok {
+			return ""
+		}
+		id := PathID(conn.ID, conn.ActivePath)
+		if !next.Alive {
+			return fmt.Sprintf("hop %s of %s is dead", next.ID, id)
+		}
+		nextConn, ok := next.Connections[id]
+		if !ok {
+			return fmt.Sprintf("hop %s has no connection %s", next.ID, id)
+		}
+		if nextConn.State != Ready.String() {
+			return fmt.Sprintf("hop %s has %s in State = %s", next.ID, id, nextConn.State)
+		}
+		conn = nextConn
+	}
+	return ""
+}
+
+type noConnectionsOnDeadActor struct{}
+
+// NoConnectionsOnDeadActor checks that killed actors have no connections
+func NoConnectionsOnDeadActor() Invariant {
+	return noConnectionsOnDeadActor{}
+}
+
+func (noConnectionsOnDeadActor) Name() string {
+	return "no-connections-on-dead-actor"
+}
+
+func (noConnectionsOnDeadActor) Check(view ClusterView, now time.Time) []Violation {
+	rv := []Violation{}
+	for _, a := range view {
+		if a.Alive {
+			continue
+		}
+		for _, conn := range a.Connections {
+			rv = append(rv, Violation{
+				Actor:        a.ID,
+				ConnectionID: conn.ID,
+				Message:      fmt.Sprintf("dead actor has the connection in State = %s", conn.State),
+			})
+		}
+	}
+	return rv
+}
+
+type deletePropagates struct {
+	within time.Duration
+	// deletes that were propagated or reported
+	done map[string]bool
+}
+
+// DeletePropagates checks that the connection deleted on the hop is deleted
+// on the next alive hop within the duration, the next hop usually deletes it first
+func DeletePropagates(within time.Duration) Invariant {
+	return &deletePropagates{
+		within: within,
+		done:   map[string]bool{},
+	}
+}
+
+func (d *deletePropagates) Name() string {
+	return "delete-propagates"
+}
+
+func (d *deletePropagates) Check(view ClusterView, now time.Time) []Violation {
+	rv := []Violation{}
+	for _, a := range view {
+		for _, deleted := range a.Deleted {
+			key := fmt.Sprintf("%s/%s/%d", a.ID, deleted.ID, deleted.At.UnixNano())
+			if deleted.NextID == "" || d.done[key] {
+				continue
+			}
+
+			next, ok := view[deleted.NextID]
+			id := PathID(deleted.ID, deleted.ActivePath)
+			if !ok || !next.Alive {
+				d.done[key] = true
+				continue
+			}
+			if _, ok := next.Connections[id]; !ok {
+				d.done[key] = true
+				continue
+			}
+			if now.Sub(deleted.At) > d.within {
+				d.done[key] = true
+				rv = append(rv, Violation{
+					Actor:        a.ID,
+					ConnectionID: deleted.ID,
+					Message:      fmt.Sprintf("connection is deleted, but %s still has %s after %v", next.ID, id, d.within),
+				})
+			}
+		}
+	}
+	return rv
+}
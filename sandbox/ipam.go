@@ -0,0 +1,189 @@
+package sandbox
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// IPContext holds addresses of the connection on both ends
+type IPContext struct {
+	SrcIPAddr string
+	DstIPAddr string
+}
+
+func (c IPContext) IsEmpty() bool {
+	return c.SrcIPAddr == "" && c.DstIPAddr == ""
+}
+
+// IPAM allocates a pair of /32 addresses per connection from its prefixes
+type IPAM interface {
+	// Allocate keeps the preferred addresses if they are free or held by
+	// another path of the same connection, see PathID
+	Allocate(connID string, preferred IPContext) (IPContext, error)
+	Release(connID string)
+}
+
+type lease struct {
+	ctx IPContext
+	// connections holding the addresses
+	holders map[string]bool
+}
+
+type ipam struct {
+	mtx      sync.Mutex
+	prefixes []*net.IPNet
+	// address -> lease
+	used   map[string]*lease
+	leases map[string]*lease
+}
+
+func NewIPAM(prefixes ...string) (IPAM, error) {
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no prefixes")
+	}
+	rv := &ipam{
+		used:   map[string]*lease{},
+		leases: map[string]*lease{},
+	}
+	for _, p := range prefixes {
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		if ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("prefix '%s' is not IPv4", p)
+		}
+		rv.prefixes = append(rv.prefixes, ipNet)
+	}
+	return rv, nil
+}
+
+func (i *ipam) Allocate(connID string, preferred IPContext) (IPContext, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if l, ok := i.leases[connID]; ok {
+		return l.ctx, nil
+	}
+
+	if l := i.reusable(connID, preferred); l != nil {
+		l.holders[connID] = true
+		i.leases[connID] = l
+		return l.ctx, nil
+	}
+
+	src, err := i.free()
+	if err != nil {
+		return IPContext{}, err
+	}
+	i.used[src] = nil
+	dst, err := i.free()
+	delete(i.used, src)
+	if err != nil {
+		return IPContext{}, err
+	}
+
+	l := &lease{
+		ctx:     IPContext{SrcIPAddr: src, DstIPAddr: dst},
+		holders: map[string]bool{connID: true},
+	}
+	i.used[src], i.used[dst] = l, l
+	i.leases[connID] = l
+	return l.ctx, nil
+}
+
+// reusable returns the lease of preferred addresses, a new one if they are free
+func (i *ipam) reusable(connID string, preferred IPContext) *lease {
+	if preferred.SrcIPAddr == "" || preferred.DstIPAddr == "" {
+		return nil
+	}
+
+	src, srcUsed := i.used[preferred.SrcIPAddr]
+	dst, dstUsed := i.used[preferred.DstIPAddr]
+	switch {
+	case !srcUsed && !dstUsed:
+		if !i.contains(preferred.SrcIPAddr) || !i.contains(preferred.DstIPAddr) {
+			return nil
+		}
+		l := &lease{ctx: preferred, holders: map[string]bool{}}
+		i.used[preferred.SrcIPAddr], i.used[preferred.DstIPAddr] = l, l
+		return l
+	case src == dst && src.ctx == preferred:
+		for holder := range src.holders {
+			if pathOwner(holder) == pathOwner(connID) {
+				return src
+			}
+		}
+	}
+	return nil
+}
+
+func (i *ipam) Release(connID string) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	l, ok := i.leases[connID]
+	if !ok {
+		return
+	}
+	delete(i.leases, connID)
+	delete(l.holders, connID)
+	if len(l.holders) == 0 {
+		delete(i.used, l.ctx.SrcIPAddr)
+		delete(i.used, l.ctx.DstIPAddr)
+	}
+}
+
+func (i *ipam) contains(addr string) bool {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		return false
+	}
+	for _, p := range i.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// free returns the first free address, network and broadcast addresses
+// are skipped unless the prefix is /31 or /32, which have none
+func (i *ipam) free() (string, error) {
+	for _, p := range i.prefixes {
+		ones, bits := p.Mask.Size()
+		size := uint64(1) << uint(bits-ones)
+		begin, end := uint64(0), size
+		if size > 2 {
+			begin, end = 1, size-1
+		}
+
+		first := uint64(binary.BigEndian.Uint32(p.IP.To4()))
+		for n := begin; n < end; n++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, uint32(first+n))
+			addr := fmt.Sprintf("%s/32", ip)
+			if _, ok := i.used[addr]; !ok {
+				return addr, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no free addresses in %v", i.prefixes)
+}
+
+// WithIPAM makes the Actor allocate addresses of connections it ends
+func WithIPAM(ipam IPAM) Option {
+	return func(a *actor) {
+		a.ipam = ipam
+	}
+}
+
+// WithAddressReallocation makes the Actor drop addresses of the connection
+// when it heals it, the endpoint allocates new ones
+func WithAddressReallocation() Option {
+	return func(a *actor) {
+		a.healerOpts = append(a.healerOpts, ReallocateAddresses())
+	}
+}
@@ -0,0 +1,212 @@
+package sandbox
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields of the entry, Actors set ActorIDField, ClassField and NodeField
+// on their Logger, the rest is set per entry
+type Fields map[string]interface{}
+
+const (
+	ActorIDField = "actor_id"
+	ClassField   = "class"
+	NodeField    = "node"
+	ConnIDField  = "conn_id"
+	StateField   = "state"
+	EventField   = "event"
+	// SupervisorIDField is set by the supervisor, see SupervisorPolicy
+	SupervisorIDField = "supervisor_id"
+)
+
+// Logger is the structured logger of the Actor, see WithLogger
+type Logger interface {
+	// WithFields returns the Logger that adds fields to every entry
+	WithFields(fields Fields) Logger
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// DefaultLogger writes to the standard logrus logger
+var DefaultLogger = NewLogrusLogger(logrus.StandardLogger())
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func NewLogrusLogger(logger *logrus.Logger) Logger {
+	return &logrusLogger{entry: logrus.NewEntry(logger)}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l *logrusLogger) Debugf(format string, args ...interface{}) {
+	l.entry.Debugf(format, args...)
+}
+
+func (l *logrusLogger) Infof(format string, args ...interface{}) {
+	l.entry.Infof(format, args...)
+}
+
+func (l *logrusLogger) Warnf(format string, args ...interface{}) {
+	l.entry.Warnf(format, args...)
+}
+
+func (l *logrusLogger) Errorf(format string, args ...interface{}) {
+	l.entry.Errorf(format, args...)
+}
+
+type LogLevel int
+
+const (
+	DebugLevel LogLevel = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		panic("unknown log level")
+	}
+}
+
+type LogEntry struct {
+	Time    time.Time
+	Level   LogLevel
+	Message string
+	Fields  Fields
+}
+
+func (e LogEntry) String() string {
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%v", k, e.Fields[k]))
+	}
+	return fmt.Sprintf("%s %-5s %s %s", e.Time.Format("15:04:05.000000"), e.Level, e.Message, strings.Join(fields, " "))
+}
+
+// CaptureLogger keeps entries in memory instead of printing them,
+// so the test prints only logs of actors it is interested in
+type CaptureLogger interface {
+	Logger
+	Entries() []LogEntry
+	// Filter returns entries of given actors, all entries if ids are empty
+	Filter(actorIDs ...string) []LogEntry
+	// WriteTo writes entries of given actors line by line
+	WriteTo(w io.Writer, actorIDs ...string) error
+}
+
+type captureSink struct {
+	sync.Mutex
+	entries []LogEntry
+}
+
+type captureLogger struct {
+	sink   *captureSink
+	fields Fields
+}
+
+func NewCaptureLogger() CaptureLogger {
+	return &captureLogger{
+		sink:   &captureSink{},
+		fields: Fields{},
+	}
+}
+
+func (c *captureLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(c.fields)+len(fields))
+	for k, v := range c.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &captureLogger{sink: c.sink, fields: merged}
+}
+
+func (c *captureLogger) add(level LogLevel, format string, args ...interface{}) {
+	c.sink.Lock()
+	defer c.sink.Unlock()
+	c.sink.entries = append(c.sink.entries, LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: fmt.Sprintf(format, args...),
+		Fields:  c.fields,
+	})
+}
+
+func (c *captureLogger) Debugf(format string, args ...interface{}) {
+	c.add(DebugLevel, format, args...)
+}
+
+func (c *captureLogger) Infof(format string, args ...interface{}) {
+	c.add(InfoLevel, format, args...)
+}
+
+func (c *captureLogger) Warnf(format string, args ...interface{}) {
+	c.add(WarnLevel, format, args...)
+}
+
+func (c *captureLogger) Errorf(format string, args ...interface{}) {
+	c.add(ErrorLevel, format, args...)
+}
+
+func (c *captureLogger) Entries() []LogEntry {
+	c.sink.Lock()
+	defer c.sink.Unlock()
+	return append([]LogEntry{}, c.sink.entries...)
+}
+
+func (c *captureLogger) Filter(actorIDs ...string) []LogEntry {
+	if len(actorIDs) == 0 {
+		return c.Entries()
+	}
+	ids := map[string]bool{}
+	for _, id := range actorIDs {
+		ids[id] = true
+	}
+
+	rv := []LogEntry{}
+	for _, e := range c.Entries() {
+		if id, ok := e.Fields[ActorIDField].(string); ok && ids[id] {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+func (c *captureLogger) WriteTo(w io.Writer, actorIDs ...string) error {
+	for _, e := range c.Filter(actorIDs...) {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
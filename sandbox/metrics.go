@@ -0,0 +1,381 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric is a family of series with the same name, series are
+// told apart by values of labels
+type Metric interface {
+	// Add increases the counter or the gauge
+	Add(v float64, labelValues ...string)
+	// Set sets the gauge
+	Set(v float64, labelValues ...string)
+	// Observe adds the sample to the histogram
+	Observe(v float64, labelValues ...string)
+	// Value returns the value of the counter or the gauge,
+	// and the number of samples of the histogram
+	Value(labelValues ...string) float64
+}
+
+// MetricsRegistry keeps metrics and writes them in Prometheus text
+// exposition format. Registering the name again returns the same metric,
+// it panics if the kind or labels differ
+type MetricsRegistry interface {
+	Counter(name, help string, labels ...string) Metric
+	Gauge(name, help string, labels ...string) Metric
+	Histogram(name, help string, buckets []float64, labels ...string) Metric
+	WriteText(w io.Writer) error
+	Handler() http.Handler
+}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+type series struct {
+	labelValues []string
+	value       float64
+	// cumulative counts of histogram buckets
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type metric struct {
+	mtx     sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected labels %v, got values %v", m.name, m.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string{}, labelValues...),
+			buckets:     make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.get(labelValues).value += v
+}
+
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.get(labelValues).value = v
+}
+
+func (m *metric) Observe(v float64, labelValues ...string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s := m.get(labelValues)
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (m *metric) Value(labelValues ...string) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s := m.get(labelValues)
+	if m.kind == histogramType {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+func (m *metric) write(w io.Writer) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := []string{}
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != histogramType {
+			lines = append(lines, fmt.Sprintf("%s%s %s", m.name, m.labelPairs(s, ""), formatFloat(s.value)))
+			continue
+		}
+		for i, upper := range m.buckets {
+			lines = append(lines, fmt.Sprintf("%s_bucket%s %d", m.name, m.labelPairs(s, formatFloat(upper)), s.buckets[i]))
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s_bucket%s %d", m.name, m.labelPairs(s, "+Inf"), s.count),
+			fmt.Sprintf("%s_sum%s %s", m.name, m.labelPairs(s, ""), formatFloat(s.sum)),
+			fmt.Sprintf("%s_count%s %d", m.name, m.labelPairs(s, ""), s.count))
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelPairs formats labels of the series, le is the bucket of the histogram
+func (m *metric) labelPairs(s *series, le string) string {
+	pairs := []string{}
+	for i, l := range m.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", l, strconv.Quote(s.labelValues[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type metricsRegistry struct {
+	mtx     sync.Mutex
+	metrics []*metric
+}
+
+func NewMetricsRegistry() MetricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (r *metricsRegistry) register(name, help, kind string, buckets []float64, labels []string) Metric {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, m := range r.metrics {
+		if m.name != name {
+			continue
+		}
+		if m.kind != kind || strings.Join(m.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric %s is registered as %s %v, got %s %v", name, m.kind, m.labels, kind, labels))
+		}
+		return m
+	}
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *metricsRegistry) Counter(name, help string, labels ...string) Metric {
+	return r.register(name, help, counterType, nil, labels)
+}
+
+func (r *metricsRegistry) Gauge(name, help string, labels ...string) Metric {
+	return r.register(name, help, gaugeType, nil, labels)
+}
+
+func (r *metricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) Metric {
+	return r.register(name, help, histogramType, buckets, labels)
+}
+
+func (r *metricsRegistry) WriteText(w io.Writer) error {
+	r.mtx.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.mtx.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *metricsRegistry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+var (
+	latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	stateBuckets   = []float64{.01, .1, .5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics of actors, healers and routers
+type Metrics struct {
+	Registry MetricsRegistry
+
+	Requests        Metric
+	RequestDuration Metric
+
+	HealTransitions   Metric
+	HealStateDuration Metric
+	HealOutcomes      Metric
+
+	MonitorSubscribers   Metric
+	MonitorDroppedEvents Metric
+
+	RouterRegistrations Metric
+	RouterLookups       Metric
+	RoutePlans          Metric
+}
+
+const (
+	// Healing repaired the connection
+	HealedOutcome = "healed"
+	// The connection was switched to the standby path
+	FailoverOutcome = "failover"
+	// The connection was closed instead of healing
+	ClosedOutcome = "closed"
+)
+
+func NewMetrics(registry MetricsRegistry) *Metrics {
+	return &Metrics{
+		Registry: registry,
+
+		Requests: registry.Counter("healsandbox_requests_total",
+			"Requests handled by actors.", "class", "result"),
+		RequestDuration: registry.Histogram("healsandbox_request_duration_seconds",
+			"Time to handle the request including the rest of the route.", latencyBuckets, "class"),
+
+		HealTransitions: registry.Counter("healsandbox_heal_transitions_total",
+			"Transitions of connection states.", "from", "to", "event"),
+		HealStateDuration: registry.Histogram("healsandbox_heal_state_duration_seconds",
+			"Time connections spent in WaitSrc, WaitDst and Healing.", stateBuckets, "state"),
+		HealOutcomes: registry.Counter("healsandbox_heal_outcomes_total",
+			"How connections left WaitSrc, WaitDst and Healing.", "outcome"),
+
+		MonitorSubscribers: registry.Gauge("healsandbox_monitor_subscribers",
+			"Subscriptions to connection events of the actor.", "actor"),
+		MonitorDroppedEvents: registry.Counter("healsandbox_monitor_dropped_events_total",
+			"Connection events dropped because the subscriber didn't read them.", "actor"),
+
+		RouterRegistrations: registry.Counter("healsandbox_router_registrations_total",
+			"Actors registered in the router.", "class"),
+		RouterLookups: registry.Counter("healsandbox_router_lookups_total",
+			"Route hops resolved by the router.", "result"),
+		RoutePlans: registry.Counter("healsandbox_router_plans_total",
+			"Routes planned by the router.", "result"),
+	}
+}
+
+// DefaultMetrics is used by actors and routers created without WithMetrics
+var DefaultMetrics = NewMetrics(NewMetricsRegistry())
+
+// WithMetrics sets metrics of the Actor and its healer
+func WithMetrics(metrics *Metrics) Option {
+	return func(a *actor) {
+		a.metrics = metrics
+	}
+}
+
+func WithRouterMetrics(metrics *Metrics) RouterOption {
+	return func(r *router) {
+		r.metrics = metrics
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// MetricsServer is the HTTP endpoint serving the registry on /metrics
+type MetricsServer interface {
+	Addr() string
+	Stop() error
+}
+
+type metricsServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// ServeMetrics starts the endpoint, addr must be a loopback address
+// since the sandbox is not supposed to be reachable from outside
+func ServeMetrics(addr string, registry MetricsRegistry) (MetricsServer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("metrics endpoint '%s' is not on localhost", addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	rv := &metricsServer{
+		listener: listener,
+		server:   &http.Server{Handler: mux},
+	}
+	go func() {
+		_ = rv.server.Serve(listener)
+	}()
+	return rv, nil
+}
+
+func (s *metricsServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *metricsServer) Stop() error {
+	return s.server.Close()
+}
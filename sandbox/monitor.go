@@ -28,6 +28,10 @@ const (
 
 const capacity = 10
 
+// queueLimit is how many events wait for the subscriber that doesn't
+// read them, newer events are dropped
+const queueLimit = 100
+
 type ConnectionEvent struct {
 	EventType   ConnectionEventType
 	Connections map[string]*ConnectionWrapper
@@ -35,6 +39,8 @@ type ConnectionEvent struct {
 
 type Monitor interface {
 	Monitor() <-chan ConnectionEvent
+	// Unsubscribe stops sending events to the channel returned by Monitor
+	Unsubscribe(ch <-chan ConnectionEvent)
 }
 
 type ConnectionDomain interface {
@@ -45,16 +51,28 @@ type ConnectionDomain interface {
 
 type connectionMonitor struct {
 	sync.Mutex
-	recipients  []chan<- ConnectionEvent
-	logFunc     func(connID, str string)
+	recipients []*subscriber
+	logFunc    func(connID, format string, args ...interface{})
+	// wrappers for the healer and their latest snapshots for the rest
 	connections sync.Map
+	snapshots   sync.Map
+	store       ConnectionStore
+	// recorded is called for every Update and Delete, see Recorder
+	recorded func(event ConnectionEvent)
+
+	// ID of the Actor for metrics
+	id      string
+	metrics *Metrics
 }
 
-func newConnectionMonitor(logFunc func(connID, str string)) *connectionMonitor {
+func newConnectionMonitor(store ConnectionStore, logFunc func(connID, format string, args ...interface{})) *connectionMonitor {
 	return &connectionMonitor{
-		recipients:  []chan<- ConnectionEvent{},
+		recipients:  []*subscriber{},
 		logFunc:     logFunc,
 		connections: sync.Map{},
+		snapshots:   sync.Map{},
+		store:       store,
+		metrics:     DefaultMetrics,
 	}
 }
 
@@ -62,56 +80,118 @@ func (cm *connectionMonitor) Monitor() <-chan ConnectionEvent {
 	cm.Lock()
 	defer cm.Unlock()
 	ch := make(chan ConnectionEvent, capacity)
-	cm.recipients = append(cm.recipients, ch)
-
-	go func() {
-		conns := map[string]*ConnectionWrapper{}
-		cm.connections.Range(func(key, value interface{}) bool {
-			conns[key.(string)] = value.(*ConnectionWrapper)
+	sub := newSubscriber((<-chan ConnectionEvent)(ch), func(event interface{}, doneCh <-chan struct{}) bool {
+		select {
+		case ch <- event.(ConnectionEvent):
 			return true
-		})
-		ch <- ConnectionEvent{
-			EventType:   InitialTransfer,
-			Connections: conns,
+		case <-doneCh:
+			return false
 		}
-	}()
+	})
+	cm.recipients = append(cm.recipients, sub)
+	cm.metrics.MonitorSubscribers.Set(float64(len(cm.recipients)), cm.id)
+
+	conns := map[string]*ConnectionWrapper{}
+	cm.snapshots.Range(func(key, value interface{}) bool {
+		conns[key.(string)] = value.(*ConnectionWrapper)
+		return true
+	})
+	// it's queued before any update sent after the subscription
+	sub.push(ConnectionEvent{
+		EventType:   InitialTransfer,
+		Connections: conns,
+	})
+	go sub.pump()
 	return ch
 }
 
+func (cm *connectionMonitor) Unsubscribe(ch <-chan ConnectionEvent) {
+	cm.Lock()
+	defer cm.Unlock()
+	for i, r := range cm.recipients {
+		if r.key == interface{}(ch) {
+			cm.recipients = append(cm.recipients[:i], cm.recipients[i+1:]...)
+			close(r.doneCh)
+			break
+		}
+	}
+	cm.metrics.MonitorSubscribers.Set(float64(len(cm.recipients)), cm.id)
+}
+
+// List returns snapshots of connections
 func (cm *connectionMonitor) List() (conns []*ConnectionWrapper) {
-	cm.connections.Range(func(key, value interface{}) bool {
+	cm.snapshots.Range(func(key, value interface{}) bool {
 		conns = append(conns, value.(*ConnectionWrapper))
 		return true
 	})
 	return
 }
 
+// Update publishes the snapshot of the connection,
+// it's called by the owner of the wrapper
 func (cm *connectionMonitor) Update(cw *ConnectionWrapper) {
-	cm.logFunc(cw.ID, fmt.Sprintf("update: %v", cw))
+	cm.logFunc(cw.ID, "update: %v", cw)
+	snapshot := cw.snapshot()
 	cm.connections.Store(cw.ID, cw)
+	cm.snapshots.Store(cw.ID, snapshot)
+	if err := cm.store.Store(newConnectionRecord(snapshot)); err != nil {
+		cm.logFunc(cw.ID, "failed to persist: %v", err)
+	}
 	cm.send(ConnectionEvent{
 		EventType: Update,
 		Connections: map[string]*ConnectionWrapper{
-			cw.ID: cw,
+			cw.ID: snapshot,
 		},
 	})
 }
 
 func (cm *connectionMonitor) Delete(connID string, silent bool) {
+	if snapshot, ok := cm.remove(connID); ok && !silent {
+		cm.sendDelete(snapshot)
+	}
+}
+
+// remove stops the connection and deletes it from the store, it returns
+// the last snapshot unless the connection is detached already
+func (cm *connectionMonitor) remove(connID string) (*ConnectionWrapper, bool) {
 	cm.logFunc(connID, "delete")
-	uncast, _ := cm.connections.Load(connID)
+	uncast, ok := cm.connections.Load(connID)
+	if !ok {
+		// detached by Kill
+		return nil, false
+	}
 	cw := uncast.(*ConnectionWrapper)
 	cw.Destroy()
+	snapshot := cw.snapshot()
 
 	cm.connections.Delete(connID)
-	if !silent {
-		cm.send(ConnectionEvent{
-			EventType: Delete,
-			Connections: map[string]*ConnectionWrapper{
-				connID: cw,
-			},
-		})
+	cm.snapshots.Delete(connID)
+	if err := cm.store.Delete(connID); err != nil {
+		cm.logFunc(connID, "failed to persist: %v", err)
 	}
+	return snapshot, true
+}
+
+func (cm *connectionMonitor) sendDelete(snapshot *ConnectionWrapper) {
+	cm.send(ConnectionEvent{
+		EventType: Delete,
+		Connections: map[string]*ConnectionWrapper{
+			snapshot.ID: snapshot,
+		},
+	})
+}
+
+// detach stops monitoring of the connection but keeps it in the store,
+// so it can be recovered by the next instance of the Actor
+func (cm *connectionMonitor) detach(connID string) {
+	cm.logFunc(connID, "detach")
+	uncast, ok := cm.connections.Load(connID)
+	if !ok {
+		return
+	}
+	uncast.(*ConnectionWrapper).Destroy()
+	cm.connections.Delete(connID)
+	cm.snapshots.Delete(connID)
 }
 
 func (cm *connectionMonitor) Get(connID string) (*ConnectionWrapper, error) {
@@ -123,11 +203,98 @@ func (cm *connectionMonitor) Get(connID string) (*ConnectionWrapper, error) {
 	return conn.(*ConnectionWrapper), nil
 }
 
+// latest returns the last published snapshot of the connection
+func (cm *connectionMonitor) latest(connID string) (*ConnectionWrapper, error) {
+	conn, ok := cm.snapshots.Load(connID)
+	if !ok {
+		return nil, fmt.Errorf("no connection with id %v", connID)
+	}
+
+	return conn.(*ConnectionWrapper), nil
+}
+
+// send queues the event for every subscriber, it doesn't wait for them
 func (cm *connectionMonitor) send(event ConnectionEvent) {
+	if cm.recorded != nil {
+		cm.recorded(event)
+	}
+
 	cm.Lock()
 	defer cm.Unlock()
 
-	for _, ch := range cm.recipients {
-		ch <- event
+	for _, sub := range cm.recipients {
+		if !sub.push(event) {
+			cm.logFunc("", "subscriber is full, %v event dropped", event.EventType)
+			cm.metrics.MonitorDroppedEvents.Add(1, cm.id)
+		}
+	}
+}
+
+// subscriber keeps events in order until they are read from its channel,
+// so the slow subscriber doesn't block the sender
+type subscriber struct {
+	mtx    sync.Mutex
+	queue  []interface{}
+	wakeCh chan struct{}
+	doneCh chan struct{}
+	// key is the channel given to the subscriber, see Unsubscribe
+	key interface{}
+	// deliver blocks until the event is read or the subscriber leaves
+	deliver func(event interface{}, doneCh <-chan struct{}) bool
+}
+
+func newSubscriber(key interface{}, deliver func(event interface{}, doneCh <-chan struct{}) bool) *subscriber {
+	return &subscriber{
+		wakeCh:  make(chan struct{}, 1),
+		doneCh:  make(chan struct{}),
+		key:     key,
+		deliver: deliver,
+	}
+}
+
+// push returns false if the event is dropped
+func (s *subscriber) push(event interface{}) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.queue) >= queueLimit {
+		return false
+	}
+	s.queue = append(s.queue, event)
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *subscriber) pop() (interface{}, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil, false
+	}
+	event := s.queue[0]
+	s.queue = s.queue[1:]
+	return event, true
+}
+
+// pump delivers queued events until the subscriber unsubscribes
+func (s *subscriber) pump() {
+	for {
+		event, ok := s.pop()
+		if !ok {
+			select {
+			case <-s.wakeCh:
+				continue
+			case <-s.doneCh:
+				return
+			}
+		}
+
+		if !s.deliver(event, s.doneCh) {
+			return
+		}
 	}
 }
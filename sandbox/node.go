@@ -0,0 +1,105 @@
+package sandbox
+
+import (
+	"sync"
+)
+
+// Cluster operates on all actors of the Meta.Node at once
+type Cluster interface {
+	// KillNode kills all alive actors of the node simultaneously
+	KillNode(node string) []Actor
+	// FreezeNode makes actors of the node unresponsive, they are alive
+	// but can't be requested and are unreachable from other nodes
+	FreezeNode(node string)
+	UnfreezeNode(node string)
+	// PartitionNode cuts the node from the rest of the cluster
+	PartitionNode(node string)
+	ReconnectNode(node string)
+
+	IsFrozen(node string) bool
+	Reachable(from, to string) bool
+	// Changed returns the channel closed on the next change of reachability
+	Changed() <-chan struct{}
+}
+
+func (r *router) KillNode(node string) []Actor {
+	r.mtx.RLock()
+	actors := []Actor{}
+	for _, a := range r.actors {
+		if a.GetMeta().Node == node && a.IsAlive() {
+			actors = append(actors, a)
+		}
+	}
+	r.mtx.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, a := range actors {
+		wg.Add(1)
+		go func(a Actor) {
+			defer wg.Done()
+			a.Kill()
+		}(a)
+	}
+	wg.Wait()
+
+	return actors
+}
+
+func (r *router) FreezeNode(node string) {
+	r.setNodeFlag(r.frozen, node, true)
+}
+
+func (r *router) UnfreezeNode(node string) {
+	r.setNodeFlag(r.frozen, node, false)
+}
+
+func (r *router) PartitionNode(node string) {
+	r.setNodeFlag(r.partitioned, node, true)
+}
+
+func (r *router) ReconnectNode(node string) {
+	r.setNodeFlag(r.partitioned, node, false)
+}
+
+func (r *router) IsFrozen(node string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.frozen[node]
+}
+
+// Reachable reports whether actors of the node 'from' can talk to actors
+// of the node 'to'. Frozen actors don't notice anything, so the frozen node
+// can reach everything that is not behind the partition
+func (r *router) Reachable(from, to string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	if from == to {
+		return true
+	}
+	if r.partitioned[from] || r.partitioned[to] {
+		return false
+	}
+	return !r.frozen[to] || r.frozen[from]
+}
+
+func (r *router) Changed() <-chan struct{} {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.changedCh
+}
+
+func (r *router) setNodeFlag(flags map[string]bool, node string, value bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if flags[node] == value {
+		return
+	}
+	flags[node] = value
+
+	close(r.changedCh)
+	r.changedCh = make(chan struct{})
+}
@@ -0,0 +1,124 @@
+package sandbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	KernelMechanism = "kernel"
+	MemifMechanism  = "memif"
+	VxlanMechanism  = "vxlan"
+)
+
+// Mechanism is how the connection is plugged into the Actor
+type Mechanism struct {
+	Type       string
+	Parameters map[string]string `json:",omitempty"`
+}
+
+func (m Mechanism) Clone() Mechanism {
+	return Mechanism{
+		Type:       m.Type,
+		Parameters: cloneLabels(m.Parameters),
+	}
+}
+
+func cloneMechanisms(mechanisms []Mechanism) []Mechanism {
+	if mechanisms == nil {
+		return nil
+	}
+	rv := make([]Mechanism, 0, len(mechanisms))
+	for _, m := range mechanisms {
+		rv = append(rv, m.Clone())
+	}
+	return rv
+}
+
+// PathSegment is added by every Actor the request passes
+type PathSegment struct {
+	Name  string
+	Token string
+}
+
+// Interceptor inspects and modifies the request before the Actor handles it
+// and the connection before it's returned to the source, an error rejects
+// the request
+type Interceptor interface {
+	Request(self Meta, request *Request) error
+	Response(self Meta, conn *Connection)
+}
+
+// WithInterceptors adds interceptors, they are called in the given order
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(a *actor) {
+		a.interceptors = append(a.interceptors, interceptors...)
+	}
+}
+
+// WithMechanisms limits mechanisms the Actor supports, the rest of
+// Request.MechanismPreferences is dropped. All are supported by default
+func WithMechanisms(types ...string) Option {
+	return func(a *actor) {
+		a.mechanisms = types
+	}
+}
+
+func token(actorID, connID string) string {
+	sum := sha256.Sum256([]byte(actorID + "/" + connID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// segments returns segments of the request followed by the Actor
+func (a *actor) segments(request Request) []PathSegment {
+	return append(append([]PathSegment{}, request.Segments...), PathSegment{
+		Name:  a.ID,
+		Token: token(a.ID, request.ConnectionID),
+	})
+}
+
+// accept adds the path segment of the Actor, negotiates mechanisms
+// and calls interceptors
+func (a *actor) accept(request *Request) error {
+	request.Labels = cloneLabels(request.Labels)
+	request.MechanismPreferences = cloneMechanisms(request.MechanismPreferences)
+	request.Segments = a.segments(*request)
+
+	if len(a.mechanisms) != 0 && len(request.MechanismPreferences) != 0 {
+		supported := []Mechanism{}
+		for _, m := range request.MechanismPreferences {
+			for _, t := range a.mechanisms {
+				if m.Type == t {
+					supported = append(supported, m)
+				}
+			}
+		}
+		if len(supported) == 0 {
+			return fmt.Errorf("sandbox '%s' supports none of mechanisms %v", a.ID, request.MechanismPreferences)
+		}
+		request.MechanismPreferences = supported
+	}
+
+	for _, i := range a.interceptors {
+		if err := i.Request(a.Meta.Clone(), request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointConnection is the connection the last hop of the route returns,
+// it selects the most preferred mechanism
+func endpointConnection(request Request, actorID string) Connection {
+	conn := Connection{
+		ID:        request.ConnectionID,
+		LastActor: actorID,
+		Segments:  request.Segments,
+		Labels:    request.Labels,
+	}
+	if len(request.MechanismPreferences) != 0 {
+		conn.Mechanism = request.MechanismPreferences[0].Clone()
+	}
+	return conn
+}
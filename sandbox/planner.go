@@ -0,0 +1,90 @@
+package sandbox
+
+import (
+	"fmt"
+)
+
+// RoutePolicy computes hops from the source to the chosen destination
+type RoutePolicy interface {
+	Plan(src, dst Meta) []string
+}
+
+// NodeLocalPolicy passes Classes on the node of the source and then
+// Classes on the node of the destination if it is on another node,
+// e.g. nsc → nsmgr → forwarder → nsmgr → forwarder → nse
+type NodeLocalPolicy struct {
+	Classes []string
+}
+
+func (p NodeLocalPolicy) Plan(src, dst Meta) []string {
+	route := []string{idHop(src.ID)}
+	for _, class := range p.Classes {
+		route = append(route, Hop(class, src.Node))
+	}
+	if src.Node != dst.Node {
+		for _, class := range p.Classes {
+			route = append(route, Hop(class, dst.Node))
+		}
+	}
+	return append(route, idHop(dst.ID))
+}
+
+func idHop(id string) string {
+	return Selector{{Key: "id", Value: id}}.String()
+}
+
+// RouterOption configures the Router created by NewRouter
+type RouterOption func(r *router)
+
+func WithRoutePolicy(policy RoutePolicy) RouterOption {
+	return func(r *router) {
+		r.policy = policy
+	}
+}
+
+// PlanRoute chooses the destination matching the dst selector, preferring
+// the node of the source, and returns the route computed by RoutePolicy.
+// Destinations with hops that can't be resolved are skipped
+func (r *router) PlanRoute(src Meta, dst string) ([]string, error) {
+	route, err := r.planRoute(src, dst)
+	r.metrics.RoutePlans.Add(1, result(err))
+	return route, err
+}
+
+func (r *router) planRoute(src Meta, dst string) ([]string, error) {
+	candidates, err := r.FindActors(dst, src, src)
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := []Meta{}, []Meta{}
+	for _, c := range candidates {
+		meta := c.GetMeta()
+		switch {
+		case meta.Node == src.Node:
+			local = append(local, meta)
+		case r.Reachable(src.Node, meta.Node):
+			remote = append(remote, meta)
+		}
+	}
+
+	for _, meta := range append(local, remote...) {
+		route := r.policy.Plan(src, meta)
+		if r.resolvable(route, src) {
+			return route, nil
+		}
+	}
+	return nil, fmt.Errorf("no route from '%s' to '%s'", src.ID, dst)
+}
+
+func (r *router) resolvable(route []string, src Meta) bool {
+	prev := src
+	for _, hop := range route[1:] {
+		found, err := r.FindActors(hop, src, prev)
+		if err != nil || len(found) == 0 {
+			return false
+		}
+		prev = found[0].GetMeta()
+	}
+	return true
+}
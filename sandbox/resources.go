@@ -0,0 +1,229 @@
+package sandbox
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type ResourceKind string
+
+const (
+	InterfaceResource ResourceKind = "interface"
+	RouteResource     ResourceKind = "route"
+	IPResource        ResourceKind = "ip"
+)
+
+// Resource is a simulated network side-effect of the NetworkHolder Actor,
+// e.g. kernel interface of the connection
+type Resource struct {
+	Owner        string
+	ConnectionID string
+	Kind         ResourceKind
+	Name         string
+}
+
+func (r Resource) String() string {
+	return fmt.Sprintf("%s %s '%s' of connection '%s'", r.Owner, r.Kind, r.Name, r.ConnectionID)
+}
+
+// ResourceRegistry keeps resources of actors, they outlive the Actor
+// like kernel interfaces outlive the process that created them
+type ResourceRegistry interface {
+	Add(r Resource)
+	// Release removes all resources of the connection created by the owner
+	Release(owner, connID string)
+	List() []Resource
+}
+
+type resourceKey struct {
+	owner  string
+	connID string
+}
+
+type resourceRegistry struct {
+	mtx       sync.Mutex
+	resources map[resourceKey][]Resource
+}
+
+func NewResourceRegistry() ResourceRegistry {
+	return &resourceRegistry{
+		resources: map[resourceKey][]Resource{},
+	}
+}
+
+func (r *resourceRegistry) Add(res Resource) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	key := resourceKey{owner: res.Owner, connID: res.ConnectionID}
+	for _, existing := range r.resources[key] {
+		if existing == res {
+			return
+		}
+	}
+	r.resources[key] = append(r.resources[key], res)
+}
+
+func (r *resourceRegistry) Release(owner, connID string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.resources, resourceKey{owner: owner, connID: connID})
+}
+
+func (r *resourceRegistry) List() []Resource {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	rv := []Resource{}
+	for _, resources := range r.resources {
+		rv = append(rv, resources...)
+	}
+	sortResources(rv)
+	return rv
+}
+
+func sortResources(resources []Resource) {
+	sort.Slice(resources, func(i, j int) bool {
+		a, b := resources[i], resources[j]
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.ConnectionID != b.ConnectionID {
+			return a.ConnectionID < b.ConnectionID
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+}
+
+// WithResourceRegistry sets where the NetworkHolder Actor records its resources,
+// actors share the registry to be checked for leaks together
+func WithResourceRegistry(registry ResourceRegistry) Option {
+	return func(a *actor) {
+		a.resources = registry
+	}
+}
+
+// program creates resources of the connection on the NetworkHolder Actor
+func (a *actor) program(cw *ConnectionWrapper) {
+	if !a.NetworkHolder {
+		return
+	}
+	a.resources.Add(Resource{Owner: a.ID, ConnectionID: cw.ID, Kind: InterfaceResource, Name: "nsm-" + cw.ID})
+	a.resources.Add(Resource{Owner: a.ID, ConnectionID: cw.ID, Kind: RouteResource, Name: "route-" + cw.ID})
+
+	// the source end has the source address and the endpoint the destination one
+	ipContext := cw.Connection.IPContext
+	if cw.request.Current == 0 && ipContext.SrcIPAddr != "" {
+		a.resources.Add(Resource{Owner: a.ID, ConnectionID: cw.ID, Kind: IPResource, Name: ipContext.SrcIPAddr})
+	}
+	if cw.next == nil && ipContext.DstIPAddr != "" {
+		a.resources.Add(Resource{Owner: a.ID, ConnectionID: cw.ID, Kind: IPResource, Name: ipContext.DstIPAddr})
+	}
+}
+
+// Delete deletes the connection the healer has closed, the Actor releases
+// its resources before others see the Delete event. Connections detached
+// by Kill keep them, the next instance recovers and releases them
+func (a *actor) Delete(connID string, silent bool) {
+	snapshot, ok := a.connectionMonitor.remove(connID)
+	if !ok {
+		return
+	}
+	a.release(connID)
+	if !silent {
+		a.connectionMonitor.sendDelete(snapshot)
+	}
+}
+
+func (a *actor) release(connID string) {
+	a.resources.Release(a.ID, connID)
+	if a.ipam != nil {
+		a.ipam.Release(connID)
+	}
+}
+
+// LeakChecker reports resources of connections that were deleted and of
+// connections the dead Actor held, connections are tracked with ConnectionEvent
+// of actors. The recovered connection is taken over by the next instance
+type LeakChecker interface {
+	// Watch observes events of the Actor until stopCh is closed
+	Watch(actor Actor, stopCh <-chan struct{})
+	Observe(actorID string, event ConnectionEvent)
+	Leaks() []Resource
+}
+
+type leakChecker struct {
+	mtx      sync.Mutex
+	registry ResourceRegistry
+	// connections whose resources are supposed to be released
+	deleted map[resourceKey]bool
+}
+
+func NewLeakChecker(registry ResourceRegistry) LeakChecker {
+	return &leakChecker{
+		registry: registry,
+		deleted:  map[resourceKey]bool{},
+	}
+}
+
+func (l *leakChecker) Watch(actor Actor, stopCh <-chan struct{}) {
+	actorID := actor.GetMeta().ID
+	monitor := actor.Monitor()
+	go func() {
+		defer actor.Unsubscribe(monitor)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-actor.Liveness():
+				// Kill detaches connections without Delete
+				l.orphan(actorID)
+				return
+			case event := <-monitor:
+				l.Observe(actorID, event)
+			}
+		}
+	}()
+}
+
+// orphan marks connections of the dead Actor, nobody releases
+// their resources unless the next instance recovers them
+func (l *leakChecker) orphan(actorID string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for key := range l.deleted {
+		if key.owner == actorID {
+			l.deleted[key] = true
+		}
+	}
+}
+
+func (l *leakChecker) Observe(actorID string, event ConnectionEvent) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for connID := range event.Connections {
+		// the connection may be requested again after Delete
+		l.deleted[resourceKey{owner: actorID, connID: connID}] = event.EventType == Delete
+	}
+}
+
+func (l *leakChecker) Leaks() []Resource {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	rv := []Resource{}
+	for _, r := range l.registry.List() {
+		if l.deleted[resourceKey{owner: r.Owner, connID: r.ConnectionID}] {
+			rv = append(rv, r)
+		}
+	}
+	return rv
+}
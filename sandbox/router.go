@@ -2,22 +2,49 @@ package sandbox
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 )
 
 type Router interface {
-	FindActors(class string) []Actor
+	FindActors(hop string, src, prev Meta) ([]Actor, error)
+	FindActor(id string) Actor
 	Register(actor Actor)
 	StateToString() string
+	// State returns registered actors and flags of their nodes
+	State() RouterState
+	PlanRoute(src Meta, dst string) ([]string, error)
+
+	Cluster
 }
 
 type router struct {
 	mtx    sync.RWMutex
 	actors []Actor
+
+	frozen      map[string]bool
+	partitioned map[string]bool
+	changedCh   chan struct{}
+
+	policy  RoutePolicy
+	metrics *Metrics
 }
 
-func NewRouter() Router {
-	return &router{}
+func NewRouter(opts ...RouterOption) Router {
+	rv := &router{
+		frozen:      map[string]bool{},
+		partitioned: map[string]bool{},
+		changedCh:   make(chan struct{}),
+		policy:      NodeLocalPolicy{},
+		metrics:     DefaultMetrics,
+	}
+
+	for _, o := range opts {
+		o(rv)
+	}
+
+	return rv
 }
 
 func (r *router) Register(actor Actor) {
@@ -25,24 +52,140 @@ func (r *router) Register(actor Actor) {
 	defer r.mtx.Unlock()
 
 	r.actors = append(r.actors, actor)
+	r.metrics.RouterRegistrations.Add(1, actor.GetMeta().Class)
 }
 
-func (r *router) FindActors(class string) (actors []Actor) {
+// FindActors returns alive actors matching the route hop,
+// variables of the Selector are resolved using src and prev
+func (r *router) FindActors(hop string, src, prev Meta) ([]Actor, error) {
+	selector, err := ParseSelector(hop)
+	if err != nil {
+		r.metrics.RouterLookups.Add(1, "error")
+		return nil, err
+	}
+
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 
+	actors := []Actor{}
 	for i := 0; i < len(r.actors); i++ {
-		if r.actors[i].GetMeta().Class == class {
+		if selector.Matches(r.actors[i].GetMeta(), src, prev) && r.actors[i].IsAlive() {
 			actors = append(actors, r.actors[i])
 		}
 	}
-	return
+	if len(actors) == 0 {
+		r.metrics.RouterLookups.Add(1, "none")
+	} else {
+		r.metrics.RouterLookups.Add(1, "found")
+	}
+	return actors, nil
 }
 
-func (r *router) StateToString() string {
-	ids := []string{}
+// FindActor returns the latest registered Actor with the ID,
+// it is either alive or the last one that died
+func (r *router) FindActor(id string) Actor {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	var rv Actor
+	for i := len(r.actors) - 1; i >= 0; i-- {
+		if r.actors[i].GetMeta().ID != id {
+			continue
+		}
+		if r.actors[i].IsAlive() {
+			return r.actors[i]
+		}
+		if rv == nil {
+			rv = r.actors[i]
+		}
+	}
+	return rv
+}
+
+// RouterState is the view of the Router, actors are listed
+// in order of registration, restarted ones more than once
+type RouterState struct {
+	Actors []RegisteredActor `json:"actors" yaml:"actors"`
+	// sorted by name
+	Nodes []NodeState `json:"nodes" yaml:"nodes"`
+}
+
+type RegisteredActor struct {
+	ID    string `json:"id" yaml:"id"`
+	Class string `json:"class" yaml:"class"`
+	Node  string `json:"node" yaml:"node"`
+	Alive bool   `json:"alive" yaml:"alive"`
+}
+
+type NodeState struct {
+	Name        string `json:"name" yaml:"name"`
+	Frozen      bool   `json:"frozen" yaml:"frozen"`
+	Partitioned bool   `json:"partitioned" yaml:"partitioned"`
+}
+
+func (r *router) State() RouterState {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	rv := RouterState{
+		Actors: []RegisteredActor{},
+		Nodes:  []NodeState{},
+	}
+	nodes := map[string]bool{}
 	for _, a := range r.actors {
-		ids = append(ids, a.GetMeta().ID)
+		meta := a.GetMeta()
+		rv.Actors = append(rv.Actors, RegisteredActor{
+			ID:    meta.ID,
+			Class: meta.Class,
+			Node:  meta.Node,
+			Alive: a.IsAlive(),
+		})
+		nodes[meta.Node] = true
+	}
+	for node := range r.frozen {
+		nodes[node] = true
+	}
+	for node := range r.partitioned {
+		nodes[node] = true
+	}
+
+	for node := range nodes {
+		rv.Nodes = append(rv.Nodes, NodeState{
+			Name:        node,
+			Frozen:      r.frozen[node],
+			Partitioned: r.partitioned[node],
+		})
+	}
+	sort.Slice(rv.Nodes, func(i, j int) bool {
+		return rv.Nodes[i].Name < rv.Nodes[j].Name
+	})
+	return rv
+}
+
+func (r *router) StateToString() string {
+	state := r.State()
+
+	actors := []string{}
+	for _, a := range state.Actors {
+		status := "alive"
+		if !a.Alive {
+			status = "dead"
+		}
+		actors = append(actors, fmt.Sprintf("%s(%s, %s, %s)", a.ID, a.Class, a.Node, status))
+	}
+	nodes := []string{}
+	for _, n := range state.Nodes {
+		switch {
+		case n.Frozen && n.Partitioned:
+			nodes = append(nodes, fmt.Sprintf("%s(frozen, partitioned)", n.Name))
+		case n.Frozen:
+			nodes = append(nodes, fmt.Sprintf("%s(frozen)", n.Name))
+		case n.Partitioned:
+			nodes = append(nodes, fmt.Sprintf("%s(partitioned)", n.Name))
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Sprintf("actors: %s", strings.Join(actors, ", "))
 	}
-	return fmt.Sprint(ids)
+	return fmt.Sprintf("actors: %s; nodes: %s", strings.Join(actors, ", "), strings.Join(nodes, ", "))
 }
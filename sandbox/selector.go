@@ -0,0 +1,90 @@
+package sandbox
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SrcVar refers to the actor that initiated the connection
+	SrcVar = "$src"
+	// PrevVar refers to the actor that resolves the hop
+	PrevVar = "$prev"
+)
+
+type Requirement struct {
+	Key      string
+	Value    string
+	NotEqual bool
+}
+
+// Selector is a route hop, e.g. 'class=forwarder,node=$src.node'.
+// Keys 'id', 'class' and 'node' refer to Meta fields, the rest to Meta.Labels.
+// Value is either a literal or '$src.<key>'/'$prev.<key>'.
+// Hop without '=' is a shorthand for the class
+type Selector []Requirement
+
+func ParseSelector(hop string) (Selector, error) {
+	if !strings.Contains(hop, "=") {
+		return Selector{{Key: "class", Value: hop}}, nil
+	}
+
+	rv := Selector{}
+	for _, part := range strings.Split(hop, ",") {
+		r := Requirement{}
+		kv := strings.SplitN(part, "!=", 2)
+		if len(kv) == 2 {
+			r.NotEqual = true
+		} else {
+			kv = strings.SplitN(part, "=", 2)
+		}
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("hop '%s': requirement '%s' has no value", hop, part)
+		}
+
+		r.Key, r.Value = strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if r.Key == "" {
+			return nil, fmt.Errorf("hop '%s': requirement '%s' has no key", hop, part)
+		}
+		if strings.HasPrefix(r.Value, "$") && !strings.HasPrefix(r.Value, SrcVar+".") && !strings.HasPrefix(r.Value, PrevVar+".") {
+			return nil, fmt.Errorf("hop '%s': unknown variable '%s'", hop, r.Value)
+		}
+		rv = append(rv, r)
+	}
+	return rv, nil
+}
+
+// Matches checks the meta, variables are resolved using src and prev
+func (s Selector) Matches(meta, src, prev Meta) bool {
+	for _, r := range s {
+		value := r.Value
+		switch {
+		case strings.HasPrefix(value, SrcVar+"."):
+			value = src.Label(strings.TrimPrefix(value, SrcVar+"."))
+		case strings.HasPrefix(value, PrevVar+"."):
+			value = prev.Label(strings.TrimPrefix(value, PrevVar+"."))
+		}
+
+		if (meta.Label(r.Key) == value) == r.NotEqual {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := []string{}
+	for _, r := range s {
+		op := "="
+		if r.NotEqual {
+			op = "!="
+		}
+		parts = append(parts, r.Key+op+r.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Hop pins the class to the node
+func Hop(class, node string) string {
+	return Selector{{Key: "class", Value: class}, {Key: "node", Value: node}}.String()
+}
@@ -0,0 +1,154 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ActorState is the snapshot of the Actor, see Actor.State
+type ActorState struct {
+	ID            string            `json:"id" yaml:"id"`
+	Class         string            `json:"class" yaml:"class"`
+	Node          string            `json:"node" yaml:"node"`
+	NetworkHolder bool              `json:"network_holder" yaml:"network_holder"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+
+	Alive      bool `json:"alive" yaml:"alive"`
+	Registered bool `json:"registered" yaml:"registered"`
+
+	// sorted by ID
+	Connections []ConnectionState `json:"connections" yaml:"connections"`
+}
+
+type ConnectionState struct {
+	ID         string    `json:"id" yaml:"id"`
+	State      string    `json:"state" yaml:"state"`
+	StateSince time.Time `json:"state_since" yaml:"state_since"`
+	// events handled by the healer, the last one caused the current state
+	Transitions int    `json:"transitions" yaml:"transitions"`
+	LastEvent   string `json:"last_event,omitempty" yaml:"last_event,omitempty"`
+	FromID      string `json:"from,omitempty" yaml:"from,omitempty"`
+	NextID      string `json:"next,omitempty" yaml:"next,omitempty"`
+
+	ActivePath int            `json:"active_path" yaml:"active_path"`
+	Standby    map[int]string `json:"standby,omitempty" yaml:"standby,omitempty"`
+	Hops       []string       `json:"hops,omitempty" yaml:"hops,omitempty"`
+	Timers     []Timer        `json:"timers,omitempty" yaml:"timers,omitempty"`
+}
+
+func NewConnectionState(cw *ConnectionWrapper) ConnectionState {
+	rv := ConnectionState{
+		ID:          cw.ID,
+		State:       cw.State.String(),
+		StateSince:  cw.stateSince,
+		Transitions: cw.transitions,
+		ActivePath:  cw.path,
+		Hops:        cw.Hops(),
+		Timers:      cw.Timers(),
+	}
+	if cw.transitions != 0 {
+		rv.LastEvent = cw.lastEvent.String()
+	}
+	if cw.request.From != nil {
+		rv.FromID = cw.request.From.GetMeta().ID
+	}
+	if cw.next != nil {
+		rv.NextID = cw.next.GetMeta().ID
+	}
+	for _, path := range cw.standby {
+		if rv.Standby == nil {
+			rv.Standby = map[int]string{}
+		}
+		rv.Standby[path.Index] = path.Next.GetMeta().ID
+	}
+	return rv
+}
+
+// Connection returns the state of the connection on the Actor
+func (s ActorState) Connection(connID string) (ConnectionState, bool) {
+	for _, c := range s.Connections {
+		if c.ID == connID {
+			return c, true
+		}
+	}
+	return ConnectionState{}, false
+}
+
+// ClusterState is the snapshot of several Actors sorted by ID
+type ClusterState []ActorState
+
+// Snapshot takes the state of every Actor
+func Snapshot(actors ...Actor) ClusterState {
+	rv := make(ClusterState, 0, len(actors))
+	for _, a := range actors {
+		rv = append(rv, a.State())
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].ID < rv[j].ID
+	})
+	return rv
+}
+
+// Actor returns the state of the Actor with the ID
+func (s ClusterState) Actor(id string) (ActorState, bool) {
+	for _, a := range s {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return ActorState{}, false
+}
+
+func (s ClusterState) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+func (s ClusterState) WriteYAML(w io.Writer) error {
+	bytes, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
+
+// WriteTable writes one row per connection, actors without
+// connections take a row with empty connection columns
+func (s ClusterState) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTOR\tCLASS\tNODE\tALIVE\tREGISTERED\tCONNECTION\tSTATE\tFROM\tNEXT\tTIMERS")
+
+	row := func(a ActorState, c ConnectionState) {
+		timers := make([]string, 0, len(c.Timers))
+		for _, t := range c.Timers {
+			timers = append(timers, fmt.Sprintf("%s in %v", t.Name, time.Until(t.Deadline).Round(time.Millisecond)))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\t%s\t%s\t%s\t%s\t%s\n",
+			a.ID, a.Class, a.Node, a.Alive, a.Registered,
+			dash(c.ID), dash(c.State), dash(c.FromID), dash(c.NextID), dash(strings.Join(timers, ", ")))
+	}
+	for _, a := range s {
+		if len(a.Connections) == 0 {
+			row(a, ConnectionState{})
+		}
+		for _, c := range a.Connections {
+			row(a, c)
+		}
+	}
+	return tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,224 @@
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ConnectionRecord is a serializable snapshot of ConnectionWrapper,
+// peers are referenced by their IDs
+type ConnectionRecord struct {
+	Connection Connection
+	State      HealState
+	Route      []string
+	Current    int
+	Dst        string
+	Src        Meta
+	FromID     string
+	NextID     string
+	// Path of the request, see Request.Path
+	Path int
+
+	MechanismPreferences []Mechanism       `json:",omitempty"`
+	Segments             []PathSegment     `json:",omitempty"`
+	Labels               map[string]string `json:",omitempty"`
+	// Path in use and next peers of standby paths by their index
+	ActivePath int
+	Standby    map[int]string `json:",omitempty"`
+}
+
+// ConnectionStore is a backend that keeps connections of the Actor,
+// so they can be recovered after restart
+type ConnectionStore interface {
+	Store(record ConnectionRecord) error
+	Delete(connID string) error
+	Load() ([]ConnectionRecord, error)
+}
+
+func newConnectionRecord(cw *ConnectionWrapper) ConnectionRecord {
+	rv := ConnectionRecord{
+		Connection: cw.Connection,
+		State:      cw.State,
+		Route:      cw.request.Route,
+		Current:    cw.request.Current,
+		Dst:        cw.request.Dst,
+		Src:        cw.request.Src,
+
+		MechanismPreferences: cw.request.MechanismPreferences,
+		Segments:             cw.request.Segments,
+		Labels:               cw.request.Labels,
+	}
+	if cw.request.From != nil {
+		rv.FromID = cw.request.From.GetMeta().ID
+	}
+	if cw.next != nil {
+		rv.NextID = cw.next.GetMeta().ID
+	}
+	rv.Path = cw.request.Path
+	rv.ActivePath = cw.path
+	for _, path := range cw.standby {
+		if rv.Standby == nil {
+			rv.Standby = map[int]string{}
+		}
+		rv.Standby[path.Index] = path.Next.GetMeta().ID
+	}
+	return rv
+}
+
+type memoryConnectionStore struct {
+	mtx     sync.RWMutex
+	records map[string]ConnectionRecord
+}
+
+func NewMemoryConnectionStore() ConnectionStore {
+	return &memoryConnectionStore{
+		records: map[string]ConnectionRecord{},
+	}
+}
+
+func (m *memoryConnectionStore) Store(record ConnectionRecord) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.records[record.Connection.ID] = record
+	return nil
+}
+
+func (m *memoryConnectionStore) Delete(connID string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.records, connID)
+	return nil
+}
+
+func (m *memoryConnectionStore) Load() ([]ConnectionRecord, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return sortedRecords(m.records), nil
+}
+
+type fileOperation struct {
+	Op     string
+	ConnID string
+	Record *ConnectionRecord `json:",omitempty"`
+}
+
+const (
+	storeOp  = "store"
+	deleteOp = "delete"
+)
+
+// fileConnectionStore is an append-only log of JSON lines,
+// the current state is restored by replaying the whole file
+type fileConnectionStore struct {
+	mtx  sync.Mutex
+	path string
+}
+
+func NewFileConnectionStore(path string) (ConnectionStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return &fileConnectionStore{
+		path: path,
+	}, nil
+}
+
+func (f *fileConnectionStore) Store(record ConnectionRecord) error {
+	return f.append(fileOperation{
+		Op:     storeOp,
+		ConnID: record.Connection.ID,
+		Record: &record,
+	})
+}
+
+func (f *fileConnectionStore) Delete(connID string) error {
+	return f.append(fileOperation{
+		Op:     deleteOp,
+		ConnID: connID,
+	})
+}
+
+func (f *fileConnectionStore) Load() ([]ConnectionRecord, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return ReadConnectionLog(f.path)
+}
+
+func (f *fileConnectionStore) append(op fileOperation) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// ReadConnectionLog replays the file written by file ConnectionStore,
+// it is useful to inspect the state of the Actor offline
+func ReadConnectionLog(path string) ([]ConnectionRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := map[string]ConnectionRecord{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		op := fileOperation{}
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+
+		switch op.Op {
+		case storeOp:
+			if op.Record == nil {
+				return nil, fmt.Errorf("%s:%d: no record for '%s' operation", path, line, op.Op)
+			}
+			records[op.ConnID] = *op.Record
+		case deleteOp:
+			delete(records, op.ConnID)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown operation '%s'", path, line, op.Op)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sortedRecords(records), nil
+}
+
+func sortedRecords(records map[string]ConnectionRecord) []ConnectionRecord {
+	rv := make([]ConnectionRecord, 0, len(records))
+	for _, r := range records {
+		rv = append(rv, r)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Connection.ID < rv[j].Connection.ID
+	})
+	return rv
+}
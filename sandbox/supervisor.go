@@ -0,0 +1,441 @@
+package sandbox
+
+import (
+	"sync"
+	"time"
+)
+
+// Child is anything that can be supervised, both Actor and Supervisor are
+type Child interface {
+	Run()
+	Kill()
+	Liveness() <-chan struct{}
+	IsAlive() bool
+}
+
+type RestartStrategy int
+
+const (
+	// OneForOne restarts only the dead child
+	OneForOne RestartStrategy = iota
+	// OneForAll kills the rest of children and restarts all of them
+	OneForAll
+)
+
+func (s RestartStrategy) String() string {
+	switch s {
+	case OneForOne:
+		return "OneForOne"
+	case OneForAll:
+		return "OneForAll"
+	default:
+		panic("unknown restart strategy")
+	}
+}
+
+type RestartType int
+
+const (
+	// Permanent child is always restarted
+	Permanent RestartType = iota
+	// Temporary child is never restarted
+	Temporary
+)
+
+type ChildSpec struct {
+	ID      string
+	Start   func() Child
+	Restart RestartType
+}
+
+type SupervisorPolicy struct {
+	Strategy RestartStrategy
+
+	// Supervisor gives up and kills all children if there are more
+	// than MaxRestarts within Window, 0 means no limit
+	MaxRestarts int
+	Window      time.Duration
+
+	// Delay before the restart, it is doubled for every restart
+	// within Window but doesn't exceed MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Logger of the supervisor, DefaultLogger if not set
+	Logger Logger
+}
+
+type SupervisorEventType int
+
+const (
+	ChildStarted SupervisorEventType = iota
+	ChildDied
+	ChildRestarted
+	RestartLimitReached
+	SupervisorStopped
+)
+
+func (et SupervisorEventType) String() string {
+	switch et {
+	case ChildStarted:
+		return "ChildStarted"
+	case ChildDied:
+		return "ChildDied"
+	case ChildRestarted:
+		return "ChildRestarted"
+	case RestartLimitReached:
+		return "RestartLimitReached"
+	case SupervisorStopped:
+		return "SupervisorStopped"
+	default:
+		panic("unknown supervisor event type")
+	}
+}
+
+type SupervisorEvent struct {
+	EventType SupervisorEventType
+	ChildID   string
+}
+
+type Supervisor interface {
+	Child
+	Events() <-chan SupervisorEvent
+	Unsubscribe(ch <-chan SupervisorEvent)
+	Child(id string) Child
+	StartChild(spec ChildSpec)
+}
+
+type supervisedChild struct {
+	spec   ChildSpec
+	child  Child
+	joinCh chan struct{}
+}
+
+type supervisor struct {
+	mtx sync.Mutex
+
+	id       string
+	policy   SupervisorPolicy
+	logger   Logger
+	specs    []ChildSpec
+	children map[string]*supervisedChild
+	restarts []time.Time
+
+	recipientsMtx sync.Mutex
+	recipients    []*subscriber
+
+	deathCh chan *supervisedChild
+	killCh  chan struct{}
+	doneCh  chan struct{}
+	killed  bool
+	running bool
+}
+
+func NewSupervisor(id string, policy SupervisorPolicy, specs ...ChildSpec) Supervisor {
+	logger := policy.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	return &supervisor{
+		id:       id,
+		policy:   policy,
+		logger:   logger.WithFields(Fields{SupervisorIDField: id}),
+		specs:    specs,
+		children: map[string]*supervisedChild{},
+		deathCh:  make(chan *supervisedChild),
+		killCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (s *supervisor) Run() {
+	s.log("Started!")
+	defer close(s.doneCh)
+
+	s.mtx.Lock()
+	s.running = true
+	s.mtx.Unlock()
+
+	for _, spec := range s.getSpecs() {
+		s.startChild(spec, ChildStarted)
+	}
+
+	for {
+		select {
+		case <-s.killCh:
+			s.stopChildren()
+			s.send(SupervisorEvent{EventType: SupervisorStopped})
+			s.log("Stopped!")
+			return
+		case c := <-s.deathCh:
+			s.handleDeath(c)
+		}
+	}
+}
+
+func (s *supervisor) Kill() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.killed {
+		return
+	}
+	s.killed = true
+	close(s.killCh)
+}
+
+func (s *supervisor) Liveness() <-chan struct{} {
+	return s.killCh
+}
+
+func (s *supervisor) IsAlive() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return !s.killed
+}
+
+func (s *supervisor) Events() <-chan SupervisorEvent {
+	s.recipientsMtx.Lock()
+	defer s.recipientsMtx.Unlock()
+
+	ch := make(chan SupervisorEvent, capacity)
+	sub := newSubscriber((<-chan SupervisorEvent)(ch), func(event interface{}, doneCh <-chan struct{}) bool {
+		select {
+		case ch <- event.(SupervisorEvent):
+			return true
+		case <-doneCh:
+			return false
+		}
+	})
+	s.recipients = append(s.recipients, sub)
+	go sub.pump()
+	return ch
+}
+
+// Unsubscribe stops events to the channel returned by Events
+func (s *supervisor) Unsubscribe(ch <-chan SupervisorEvent) {
+	s.recipientsMtx.Lock()
+	defer s.recipientsMtx.Unlock()
+
+	for i, r := range s.recipients {
+		if r.key == interface{}(ch) {
+			close(r.doneCh)
+			s.recipients = append(s.recipients[:i], s.recipients[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *supervisor) Child(id string) Child {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, ok := s.children[id]
+	if !ok {
+		return nil
+	}
+	return c.child
+}
+
+// StartChild adds the child to the supervisor,
+// it is started immediately if the supervisor is running and not stopping
+func (s *supervisor) StartChild(spec ChildSpec) {
+	s.mtx.Lock()
+	if s.killed {
+		s.mtx.Unlock()
+		return
+	}
+	s.specs = append(s.specs, spec)
+	running := s.running
+	s.mtx.Unlock()
+
+	if running {
+		s.startChild(spec, ChildStarted)
+	}
+}
+
+func (s *supervisor) startChild(spec ChildSpec, eventType SupervisorEventType) {
+	c := &supervisedChild{
+		spec:   spec,
+		child:  spec.Start(),
+		joinCh: make(chan struct{}),
+	}
+
+	s.mtx.Lock()
+	if s.killed {
+		// Kill has already taken children to stop, nobody would stop this one
+		s.mtx.Unlock()
+		c.child.Kill()
+		return
+	}
+	s.children[spec.ID] = c
+	s.mtx.Unlock()
+
+	go func() {
+		c.child.Run()
+		close(c.joinCh)
+	}()
+
+	go func() {
+		select {
+		case <-c.child.Liveness():
+		case <-s.doneCh:
+			return
+		}
+		select {
+		case s.deathCh <- c:
+		case <-s.doneCh:
+		}
+	}()
+
+	s.logWithChild(spec.ID, eventType.String())
+	s.send(SupervisorEvent{EventType: eventType, ChildID: spec.ID})
+}
+
+func (s *supervisor) handleDeath(c *supervisedChild) {
+	s.mtx.Lock()
+	current := s.children[c.spec.ID]
+	s.mtx.Unlock()
+
+	if current != c {
+		// the child was replaced during OneForAll restart
+		return
+	}
+
+	<-c.joinCh
+	s.logWithChild(c.spec.ID, "died")
+	s.send(SupervisorEvent{EventType: ChildDied, ChildID: c.spec.ID})
+
+	if c.spec.Restart == Temporary {
+		s.removeChild(c.spec.ID)
+		return
+	}
+
+	delay, ok := s.registerRestart()
+	if !ok {
+		s.log("more than %d restarts within %v, giving up", s.policy.MaxRestarts, s.policy.Window)
+		s.send(SupervisorEvent{EventType: RestartLimitReached, ChildID: c.spec.ID})
+		s.Kill()
+		return
+	}
+
+	select {
+	case <-time.After(delay):
+	case <-s.killCh:
+		return
+	}
+
+	switch s.policy.Strategy {
+	case OneForOne:
+		s.startChild(c.spec, ChildRestarted)
+	case OneForAll:
+		restart := []ChildSpec{}
+		for _, spec := range s.getSpecs() {
+			other, ok := s.getChild(spec.ID)
+			if !ok {
+				continue
+			}
+			if other != c {
+				s.removeChild(spec.ID)
+				killChild(other)
+				if spec.Restart == Temporary {
+					continue
+				}
+			}
+			restart = append(restart, spec)
+		}
+		for _, spec := range restart {
+			s.startChild(spec, ChildRestarted)
+		}
+	}
+}
+
+// registerRestart checks the restart intensity and returns the backoff delay
+func (s *supervisor) registerRestart() (time.Duration, bool) {
+	now := time.Now()
+
+	recent := []time.Time{}
+	for _, t := range s.restarts {
+		if s.policy.Window == 0 || now.Sub(t) < s.policy.Window {
+			recent = append(recent, t)
+		}
+	}
+	s.restarts = append(recent, now)
+
+	if s.policy.MaxRestarts > 0 && len(s.restarts) > s.policy.MaxRestarts {
+		return 0, false
+	}
+
+	delay := s.policy.Backoff
+	for i := 1; i < len(s.restarts) && delay > 0; i++ {
+		delay *= 2
+		if s.policy.MaxBackoff > 0 && delay >= s.policy.MaxBackoff {
+			delay = s.policy.MaxBackoff
+			break
+		}
+	}
+	return delay, true
+}
+
+// stopChildren kills children in the order they were started
+func (s *supervisor) stopChildren() {
+	s.mtx.Lock()
+	children := s.children
+	s.children = map[string]*supervisedChild{}
+	s.mtx.Unlock()
+
+	for _, spec := range s.getSpecs() {
+		if c, ok := children[spec.ID]; ok {
+			killChild(c)
+		}
+	}
+}
+
+func (s *supervisor) getSpecs() []ChildSpec {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]ChildSpec{}, s.specs...)
+}
+
+func (s *supervisor) getChild(id string) (*supervisedChild, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	c, ok := s.children[id]
+	return c, ok
+}
+
+func (s *supervisor) removeChild(id string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.children, id)
+}
+
+func killChild(c *supervisedChild) {
+	if c.child.IsAlive() {
+		c.child.Kill()
+	}
+	<-c.joinCh
+}
+
+func (s *supervisor) send(event SupervisorEvent) {
+	s.recipientsMtx.Lock()
+	defer s.recipientsMtx.Unlock()
+
+	for _, sub := range s.recipients {
+		if !sub.push(event) {
+			s.log("subscriber is full, %v event dropped", event.EventType)
+		}
+	}
+}
+
+func (s *supervisor) log(format string, args ...interface{}) {
+	s.logger.Infof(format, args...)
+}
+
+func (s *supervisor) logWithChild(childID, format string, args ...interface{}) {
+	s.logger.WithFields(Fields{ActorIDField: childID}).Infof(format, args...)
+}
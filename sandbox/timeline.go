@@ -0,0 +1,239 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SpanRecord    = "span"
+	KillRecord    = "kill"
+	MonitorRecord = "monitor"
+)
+
+// Record is what happened on the Actor, it's instant if End is nil
+type Record struct {
+	Actor        string            `json:"actor"`
+	Kind         string            `json:"kind"`
+	Name         string            `json:"name"`
+	ConnectionID string            `json:"connection_id,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          *time.Time        `json:"end,omitempty"`
+	Args         map[string]string `json:"args,omitempty"`
+}
+
+// Recorder collects request hops, heal transitions, kills and monitor
+// events of actors, so the run can be replayed in the trace viewer
+type Recorder interface {
+	SpanExporter
+	Kill(actorID string)
+	Event(actorID string, event ConnectionEvent)
+
+	// Records returns everything recorded so far ordered by Start
+	Records() []Record
+	WriteJSON(w io.Writer) error
+	// WriteChromeTrace writes the trace-event format of chrome://tracing
+	// and Perfetto, every actor has its own lane
+	WriteChromeTrace(w io.Writer) error
+}
+
+type recorder struct {
+	mtx     sync.Mutex
+	records []Record
+}
+
+func NewRecorder() Recorder {
+	return &recorder{}
+}
+
+// WithRecorder makes the Actor record into the Recorder, spans
+// are exported to the exporter set by WithSpanExporter as well
+func WithRecorder(r Recorder) Option {
+	return func(a *actor) {
+		a.recorder = r
+	}
+}
+
+func (r *recorder) add(record Record) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.records = append(r.records, record)
+}
+
+func (r *recorder) Export(span Span) {
+	name := span.Name
+	switch span.Name {
+	case "transition":
+		name = fmt.Sprintf("%s -> %s", span.Attributes["from"], span.Attributes["to"])
+	case "heal":
+		name = fmt.Sprintf("heal after %s", span.Attributes["cause"])
+	}
+
+	args := map[string]string{
+		"trace_id": span.TraceID,
+		"span_id":  span.SpanID,
+	}
+	for k, v := range span.Attributes {
+		args[k] = v
+	}
+	if span.Error != "" {
+		args["error"] = span.Error
+	}
+
+	end := span.End
+	r.add(Record{
+		Actor:        span.Actor,
+		Kind:         SpanRecord,
+		Name:         name,
+		ConnectionID: span.ConnectionID,
+		Start:        span.Start,
+		End:          &end,
+		Args:         args,
+	})
+}
+
+func (r *recorder) Kill(actorID string) {
+	r.add(Record{
+		Actor: actorID,
+		Kind:  KillRecord,
+		Name:  "killed",
+		Start: time.Now(),
+	})
+}
+
+func (r *recorder) Event(actorID string, event ConnectionEvent) {
+	now := time.Now()
+	for id, cw := range event.Connections {
+		r.add(Record{
+			Actor:        actorID,
+			Kind:         MonitorRecord,
+			Name:         fmt.Sprintf("%v %s", event.EventType, id),
+			ConnectionID: id,
+			Start:        now,
+			Args:         map[string]string{"state": cw.State.String()},
+		})
+	}
+}
+
+func (r *recorder) Records() []Record {
+	r.mtx.Lock()
+	rv := append([]Record{}, r.records...)
+	r.mtx.Unlock()
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Start.Before(rv[j].Start)
+	})
+	return rv
+}
+
+func (r *recorder) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r.Records())
+}
+
+type traceEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"`
+	Duration int64             `json:"dur,omitempty"`
+	PID      int               `json:"pid"`
+	TID      int               `json:"tid"`
+	Scope    string            `json:"s,omitempty"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+func (r *recorder) WriteChromeTrace(w io.Writer) error {
+	records := r.Records()
+
+	actors := []string{}
+	lanes := map[string]int{}
+	for _, record := range records {
+		if _, ok := lanes[record.Actor]; !ok {
+			lanes[record.Actor] = 0
+			actors = append(actors, record.Actor)
+		}
+	}
+	sort.Strings(actors)
+
+	events := []traceEvent{}
+	for i, id := range actors {
+		lanes[id] = i + 1
+		events = append(events, traceEvent{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   1,
+			TID:   i + 1,
+			Args:  map[string]string{"name": id},
+		})
+	}
+
+	var begin time.Time
+	if len(records) != 0 {
+		begin = records[0].Start
+	}
+	for _, record := range records {
+		args := map[string]string{}
+		for k, v := range record.Args {
+			args[k] = v
+		}
+		if record.ConnectionID != "" {
+			args["connection_id"] = record.ConnectionID
+		}
+
+		event := traceEvent{
+			Name:     record.Name,
+			Category: record.Kind,
+			Phase:    "i",
+			Scope:    "t",
+			Time:     record.Start.Sub(begin).Microseconds(),
+			PID:      1,
+			TID:      lanes[record.Actor],
+			Args:     args,
+		}
+		if record.End != nil {
+			event.Phase = "X"
+			event.Scope = ""
+			event.Duration = record.End.Sub(record.Start).Microseconds()
+		}
+		events = append(events, event)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+	})
+}
+
+// WriteChromeTraceFile writes the trace of the Recorder to the file
+func WriteChromeTraceFile(r Recorder, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.WriteChromeTrace(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// multiExporter exports spans to all exporters
+type multiExporter []SpanExporter
+
+func (m multiExporter) Export(span Span) {
+	for _, e := range m {
+		e.Export(span)
+	}
+}
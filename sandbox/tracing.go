@@ -0,0 +1,248 @@
+package sandbox
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpanContext links spans of the trace, it's passed with Request
+type SpanContext struct {
+	TraceID string `json:",omitempty"`
+	SpanID  string `json:",omitempty"`
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != "" && c.SpanID != ""
+}
+
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentID     string `json:",omitempty"`
+	Name         string
+	Actor        string
+	ConnectionID string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string `json:",omitempty"`
+	Error        string            `json:",omitempty"`
+}
+
+func (s Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+func (s Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// SpanExporter receives spans when they end
+type SpanExporter interface {
+	Export(span Span)
+}
+
+// MemoryExporter collects spans, e.g. to check them in tests
+type MemoryExporter interface {
+	SpanExporter
+	Spans() []Span
+	// Trace returns spans of the trace in the order they ended
+	Trace(traceID string) []Span
+}
+
+type memoryExporter struct {
+	mtx   sync.Mutex
+	spans []Span
+}
+
+func NewMemoryExporter() MemoryExporter {
+	return &memoryExporter{}
+}
+
+func (m *memoryExporter) Export(span Span) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.spans = append(m.spans, span)
+}
+
+func (m *memoryExporter) Spans() []Span {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return append([]Span{}, m.spans...)
+}
+
+func (m *memoryExporter) Trace(traceID string) []Span {
+	rv := []Span{}
+	for _, s := range m.Spans() {
+		if s.TraceID == traceID {
+			rv = append(rv, s)
+		}
+	}
+	return rv
+}
+
+// JSONExporter appends spans to the file as JSON lines
+type JSONExporter interface {
+	SpanExporter
+	// Close flushes and closes the file, spans exported after it are dropped
+	Close() error
+}
+
+type jsonExporter struct {
+	mtx    sync.Mutex
+	file   *os.File
+	logger Logger
+}
+
+// NewJSONExporter writes spans to the file, see ReadSpans,
+// failed writes are reported to the logger
+func NewJSONExporter(path string, logger Logger) (JSONExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonExporter{file: file, logger: logger}, nil
+}
+
+func (j *jsonExporter) Export(span Span) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.file == nil {
+		return
+	}
+	data, err := json.Marshal(span)
+	if err == nil {
+		_, err = j.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		j.logger.Warnf("failed to export span %s: %v", span.SpanID, err)
+	}
+}
+
+func (j *jsonExporter) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	file := j.file
+	j.file = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadSpans reads the file written by the JSON exporter
+func ReadSpans(path string) ([]Span, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rv := []Span{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		span := Span{}
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rv = append(rv, span)
+	}
+	return rv, scanner.Err()
+}
+
+// WithSpanExporter enables tracing of requests and heal transitions of the Actor
+func WithSpanExporter(exporter SpanExporter) Option {
+	return func(a *actor) {
+		a.tracer = tracer{exporter: exporter}
+	}
+}
+
+// WithHealerSpanExporter enables tracing of heal transitions
+func WithHealerSpanExporter(exporter SpanExporter) HealerOption {
+	return func(c *CloseHealer) {
+		c.tracer = tracer{exporter: exporter}
+	}
+}
+
+// tracer doesn't record anything without the exporter
+type tracer struct {
+	exporter SpanExporter
+}
+
+type activeSpan struct {
+	span     Span
+	exporter SpanExporter
+}
+
+// start creates the child of parent, the new trace is started if parent is not valid
+func (t tracer) start(name, actorID, connID string, parent SpanContext) *activeSpan {
+	if t.exporter == nil {
+		return nil
+	}
+
+	span := Span{
+		TraceID:      parent.TraceID,
+		SpanID:       randomID(8),
+		ParentID:     parent.SpanID,
+		Name:         name,
+		Actor:        actorID,
+		ConnectionID: connID,
+		Start:        time.Now(),
+		Attributes:   map[string]string{},
+	}
+	if !parent.IsValid() {
+		span.TraceID = randomID(16)
+		span.ParentID = ""
+	}
+	return &activeSpan{span: span, exporter: t.exporter}
+}
+
+func (s *activeSpan) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.span.Context()
+}
+
+func (s *activeSpan) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.Attributes[key] = value
+}
+
+func (s *activeSpan) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.Error = err.Error()
+}
+
+func (s *activeSpan) End() {
+	if s == nil {
+		return
+	}
+	s.span.End = time.Now()
+	s.exporter.Export(s.span)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
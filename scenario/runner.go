@@ -0,0 +1,449 @@
+package scenario
+
+import (
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pollInterval = 10 * time.Millisecond
+
+// registerTimeout is how long the Start step waits for the actor to register
+const registerTimeout = 5 * time.Second
+
+type TimelineEntry struct {
+	At    time.Duration
+	Actor string
+	Event string
+}
+
+type Report struct {
+	Scenario string
+	Passed   bool
+	Failures []string
+	Timeline []TimelineEntry
+	// Resources of connections that were deleted
+	Leaks []sandbox.Resource
+}
+
+func (r Report) String() string {
+	sb := strings.Builder{}
+	result := "PASSED"
+	if !r.Passed {
+		result = "FAILED"
+	}
+	sb.WriteString(fmt.Sprintf("scenario %s: %s\n", r.Scenario, result))
+
+	if len(r.Failures) != 0 {
+		sb.WriteString("failures:\n")
+		for _, f := range r.Failures {
+			sb.WriteString(fmt.Sprintf("\t%s\n", f))
+		}
+	}
+
+	if len(r.Leaks) != 0 {
+		sb.WriteString("leaks:\n")
+		for _, l := range r.Leaks {
+			sb.WriteString(fmt.Sprintf("\t%v\n", l))
+		}
+	}
+
+	sb.WriteString("timeline:\n")
+	for _, e := range r.Timeline {
+		sb.WriteString(fmt.Sprintf("\t+%-10v %-20s %s\n", e.At.Round(time.Millisecond), e.Actor, e.Event))
+	}
+	return sb.String()
+}
+
+type connectionView struct {
+	State  sandbox.HealState
+	Closed bool
+}
+
+type runner struct {
+	mtx sync.Mutex
+
+	scenario Scenario
+	logger   sandbox.Logger
+	router   sandbox.Router
+	sup      sandbox.Supervisor
+	begin    time.Time
+
+	specs  map[string]ActorSpec
+	actors map[string]sandbox.Actor
+	// actor ID -> connection ID -> last observed state
+	states map[string]map[string]connectionView
+
+	timeline []TimelineEntry
+	failures []string
+
+	resources  sandbox.ResourceRegistry
+	leaks      sandbox.LeakChecker
+	invariants sandbox.InvariantChecker
+
+	stopCh chan struct{}
+	// stops the invariant checker before actors are killed by the cleanup
+	checkStopCh chan struct{}
+	wg          sync.WaitGroup
+}
+
+// Run executes the scenario on a fresh Router and kills all actors at the end
+func Run(s Scenario) Report {
+	r := &runner{
+		scenario:    s,
+		logger:      s.Logger,
+		router:      sandbox.NewRouter(),
+		begin:       time.Now(),
+		specs:       map[string]ActorSpec{},
+		actors:      map[string]sandbox.Actor{},
+		states:      map[string]map[string]connectionView{},
+		stopCh:      make(chan struct{}),
+		checkStopCh: make(chan struct{}),
+	}
+	if r.logger == nil {
+		r.logger = sandbox.DefaultLogger
+	}
+	r.resources = sandbox.NewResourceRegistry()
+	r.leaks = sandbox.NewLeakChecker(r.resources)
+	r.invariants = sandbox.NewInvariantChecker(s.Invariants...)
+
+	if err := r.validate(); err != nil {
+		r.fail(err.Error())
+		return r.report()
+	}
+
+	r.run()
+	return r.report()
+}
+
+func (r *runner) validate() error {
+	for _, a := range r.scenario.Actors {
+		if _, ok := r.specs[a.Meta.ID]; ok {
+			return fmt.Errorf("actor '%s' is declared twice", a.Meta.ID)
+		}
+		r.specs[a.Meta.ID] = a
+	}
+
+	for _, c := range r.scenario.Connections {
+		if _, ok := r.specs[c.From]; !ok {
+			return fmt.Errorf("connection '%s': unknown actor '%s'", c.ID, c.From)
+		}
+	}
+
+	started := map[string]bool{}
+	for i, s := range r.scenario.Steps {
+		if s.isNodeAction() {
+			if s.Node == "" {
+				return fmt.Errorf("step %d: node is not set", i)
+			}
+			continue
+		}
+		if _, ok := r.specs[s.Actor]; !ok {
+			return fmt.Errorf("step %d: unknown actor '%s'", i, s.Actor)
+		}
+		if s.Action == Request {
+			if _, ok := r.connection(s.Connection); !ok {
+				return fmt.Errorf("step %d: unknown connection '%s'", i, s.Connection)
+			}
+		}
+		if s.Action == Start {
+			// actors run once, the deferred one is started by its step
+			if !r.specs[s.Actor].Deferred {
+				return fmt.Errorf("step %d: actor '%s' is not deferred", i, s.Actor)
+			}
+			if started[s.Actor] {
+				return fmt.Errorf("step %d: actor '%s' is started twice", i, s.Actor)
+			}
+			started[s.Actor] = true
+		}
+	}
+
+	for i, e := range r.scenario.Expectations {
+		if _, ok := r.specs[e.Actor]; !ok {
+			return fmt.Errorf("expectation %d: unknown actor '%s'", i, e.Actor)
+		}
+	}
+	return nil
+}
+
+func (r *runner) run() {
+	specs := []sandbox.ChildSpec{}
+	for _, a := range r.scenario.Actors {
+		actor := sandbox.NewActor(a.Meta, r.router,
+			sandbox.WithResourceRegistry(r.resources),
+			sandbox.WithLogger(r.logger))
+		r.actors[a.Meta.ID] = actor
+		r.watch(a.Meta.ID, actor)
+		r.invariants.Watch(actor, r.checkStopCh)
+		if !a.Deferred {
+			specs = append(specs, r.childSpec(actor))
+		}
+	}
+
+	r.sup = sandbox.NewSupervisor(r.scenario.Name, sandbox.SupervisorPolicy{Logger: r.logger}, specs...)
+	r.watchSupervisor(r.sup.Events())
+
+	joinCh := make(chan struct{})
+	go func() {
+		r.sup.Run()
+		close(joinCh)
+	}()
+	defer func() {
+		r.invariants.Check()
+		close(r.checkStopCh)
+		for _, v := range r.invariants.Violations() {
+			r.fail(v.String())
+		}
+
+		r.logger.Infof("scenario %s: cleanup", r.scenario.Name)
+		r.sup.Kill()
+		<-joinCh
+		close(r.stopCh)
+		r.wg.Wait()
+
+		for _, l := range r.leaks.Leaks() {
+			r.fail(fmt.Sprintf("leaked %v", l))
+		}
+	}()
+
+	for _, a := range r.scenario.Actors {
+		if !a.Deferred {
+			<-r.actors[a.Meta.ID].IsRegistered()
+		}
+	}
+
+	for _, c := range r.scenario.Connections {
+		if err := r.request(c.From, c); err != nil {
+			r.fail(err.Error())
+			return
+		}
+	}
+
+	steps := append([]Step{}, r.scenario.Steps...)
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].At < steps[j].At
+	})
+
+	stepsBegin := time.Now()
+	for _, s := range steps {
+		<-time.After(time.Until(stepsBegin.Add(s.At)))
+		if err := r.do(s); err != nil {
+			r.fail(err.Error())
+			return
+		}
+	}
+
+	expectBegin := time.Now()
+	for _, e := range r.scenario.Expectations {
+		within := e.Within
+		if within == 0 {
+			within = DefaultWithin
+		}
+		if err := r.await(e, expectBegin.Add(within)); err != nil {
+			r.fail(err.Error())
+		}
+	}
+}
+
+func (r *runner) do(s Step) error {
+	if s.isNodeAction() {
+		r.record(s.Node, s.Action.String())
+	} else {
+		r.record(s.Actor, s.Action.String())
+	}
+
+	actor := r.actors[s.Actor]
+	switch s.Action {
+	case Kill:
+		if actor.IsAlive() {
+			actor.Kill()
+		}
+	case Start:
+		r.sup.StartChild(r.childSpec(actor))
+		select {
+		case <-actor.IsRegistered():
+		case <-time.After(registerTimeout):
+			return fmt.Errorf("actor '%s' is not registered within %v", s.Actor, registerTimeout)
+		}
+	case Request:
+		c, _ := r.connection(s.Connection)
+		return r.request(s.Actor, c)
+	case KillNode:
+		r.router.KillNode(s.Node)
+	case FreezeNode:
+		r.router.FreezeNode(s.Node)
+	case UnfreezeNode:
+		r.router.UnfreezeNode(s.Node)
+	case PartitionNode:
+		r.router.PartitionNode(s.Node)
+	case ReconnectNode:
+		r.router.ReconnectNode(s.Node)
+	}
+	return nil
+}
+
+func (r *runner) request(actorID string, c ConnectionSpec) error {
+	conn, err := r.actors[actorID].Request(sandbox.Request{
+		ConnectionID: c.ID,
+		Route:        c.Route,
+		Paths:        c.Paths,
+	})
+	if err != nil {
+		r.record(actorID, fmt.Sprintf("request %s failed: %v", c.ID, err))
+		return fmt.Errorf("request '%s' from '%s' failed: %v", c.ID, actorID, err)
+	}
+	r.record(actorID, fmt.Sprintf("request %s succeeded, last actor %s", c.ID, conn.LastActor))
+	return nil
+}
+
+func (r *runner) await(e Expectation, deadline time.Time) error {
+	for {
+		view, ok := r.lookup(e.Actor, e.Connection)
+		if ok && view.Closed == e.Closed && (e.Closed || view.State == e.State) {
+			r.record(e.Actor, fmt.Sprintf("expectation for %s satisfied", e.Connection))
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			switch {
+			case !ok:
+				return fmt.Errorf("%s: connection '%s' has never been observed", e.Actor, e.Connection)
+			case e.Closed:
+				return fmt.Errorf("%s: connection '%s' is not closed, State = %v", e.Actor, e.Connection, view.State)
+			case view.Closed:
+				return fmt.Errorf("%s: connection '%s' is closed, expected State = %v", e.Actor, e.Connection, e.State)
+			default:
+				return fmt.Errorf("%s: connection '%s' has State = %v, expected %v", e.Actor, e.Connection, view.State, e.State)
+			}
+		}
+		<-time.After(pollInterval)
+	}
+}
+
+// lookup returns the last observed state of the connection,
+// all connections of the dead actor are closed
+func (r *runner) lookup(actorID, connID string) (connectionView, bool) {
+	alive := r.actors[actorID].IsAlive()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	view, ok := r.states[actorID][connID]
+	if ok && !alive {
+		view.Closed = true
+	}
+	return view, ok
+}
+
+func (r *runner) watch(actorID string, actor sandbox.Actor) {
+	monitor := actor.Monitor()
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			select {
+			case <-r.stopCh:
+				return
+			case event := <-monitor:
+				r.apply(actorID, event)
+			}
+		}
+	}()
+}
+
+func (r *runner) watchSupervisor(events <-chan sandbox.SupervisorEvent) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.sup.Unsubscribe(events)
+		for {
+			select {
+			case <-r.stopCh:
+				return
+			case event := <-events:
+				if event.ChildID != "" {
+					r.record(event.ChildID, event.EventType.String())
+				}
+			}
+		}
+	}()
+}
+
+func (r *runner) apply(actorID string, event sandbox.ConnectionEvent) {
+	r.leaks.Observe(actorID, event)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	states, ok := r.states[actorID]
+	if !ok {
+		states = map[string]connectionView{}
+		r.states[actorID] = states
+	}
+
+	for id, cw := range event.Connections {
+		switch event.EventType {
+		case sandbox.InitialTransfer, sandbox.Update:
+			states[id] = connectionView{State: cw.State}
+			r.recordLocked(actorID, fmt.Sprintf("%s: %v State = %v", id, event.EventType, cw.State))
+		case sandbox.Delete:
+			states[id] = connectionView{State: cw.State, Closed: true}
+			r.recordLocked(actorID, fmt.Sprintf("%s: %v", id, event.EventType))
+		}
+	}
+}
+
+func (r *runner) childSpec(actor sandbox.Actor) sandbox.ChildSpec {
+	return sandbox.ChildSpec{
+		ID:      actor.GetMeta().ID,
+		Start:   func() sandbox.Child { return actor },
+		Restart: sandbox.Temporary,
+	}
+}
+
+func (r *runner) connection(connID string) (ConnectionSpec, bool) {
+	for _, c := range r.scenario.Connections {
+		if c.ID == connID {
+			return c, true
+		}
+	}
+	return ConnectionSpec{}, false
+}
+
+func (r *runner) record(actorID, event string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.recordLocked(actorID, event)
+}
+
+func (r *runner) recordLocked(actorID, event string) {
+	r.timeline = append(r.timeline, TimelineEntry{
+		At:    time.Since(r.begin),
+		Actor: actorID,
+		Event: event,
+	})
+}
+
+func (r *runner) fail(failure string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.failures = append(r.failures, failure)
+}
+
+func (r *runner) report() Report {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return Report{
+		Scenario: r.scenario.Name,
+		Passed:   len(r.failures) == 0,
+		Failures: append([]string{}, r.failures...),
+		Timeline: append([]TimelineEntry{}, r.timeline...),
+		Leaks:    r.leaks.Leaks(),
+	}
+}
@@ -0,0 +1,213 @@
+package scenario
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"time"
+)
+
+// DefaultWithin is used by expectations that don't set their own timeout
+const DefaultWithin = 15 * time.Second
+
+type ActorSpec struct {
+	Meta sandbox.Meta
+
+	// Deferred actor is not started with the rest,
+	// it has to be started by the Start step
+	Deferred bool
+}
+
+type ConnectionSpec struct {
+	ID    string
+	From  string
+	Route []string
+	// Number of redundant paths, see sandbox.Request.Paths
+	Paths int
+}
+
+type StepAction int
+
+const (
+	Kill StepAction = iota
+	Start
+	Request
+	KillNode
+	FreezeNode
+	UnfreezeNode
+	PartitionNode
+	ReconnectNode
+)
+
+func (a StepAction) String() string {
+	switch a {
+	case Kill:
+		return "Kill"
+	case Start:
+		return "Start"
+	case Request:
+		return "Request"
+	case KillNode:
+		return "KillNode"
+	case FreezeNode:
+		return "FreezeNode"
+	case UnfreezeNode:
+		return "UnfreezeNode"
+	case PartitionNode:
+		return "PartitionNode"
+	case ReconnectNode:
+		return "ReconnectNode"
+	default:
+		panic("unknown step action")
+	}
+}
+
+// Step is a timed fault or action, At is counted from the moment
+// when all connections are established. Node actions use Node instead of Actor
+type Step struct {
+	At         time.Duration
+	Action     StepAction
+	Actor      string
+	Node       string
+	Connection string
+}
+
+func (s Step) isNodeAction() bool {
+	return s.Action >= KillNode
+}
+
+// Expectation is satisfied when connection observed on the actor is in State,
+// or is removed from it if Closed is set
+type Expectation struct {
+	Actor      string
+	Connection string
+	State      sandbox.HealState
+	Closed     bool
+	Within     time.Duration
+}
+
+type Scenario struct {
+	Name         string
+	Actors       []ActorSpec
+	Connections  []ConnectionSpec
+	Steps        []Step
+	Expectations []Expectation
+	// Invariants are checked during the whole run, they keep state,
+	// so every Run needs new instances
+	Invariants []sandbox.Invariant
+	// Logger of actors, the supervisor and the runner, DefaultLogger if not set
+	Logger sandbox.Logger
+}
+
+type Builder struct {
+	scenario Scenario
+}
+
+func New(name string) *Builder {
+	return &Builder{
+		scenario: Scenario{Name: name},
+	}
+}
+
+func (b *Builder) Logger(logger sandbox.Logger) *Builder {
+	b.scenario.Logger = logger
+	return b
+}
+
+func (b *Builder) Actors(meta ...sandbox.Meta) *Builder {
+	for _, m := range meta {
+		b.scenario.Actors = append(b.scenario.Actors, ActorSpec{Meta: m})
+	}
+	return b
+}
+
+func (b *Builder) DeferredActor(meta sandbox.Meta) *Builder {
+	b.scenario.Actors = append(b.scenario.Actors, ActorSpec{Meta: meta, Deferred: true})
+	return b
+}
+
+func (b *Builder) Connection(id, from string, route ...string) *Builder {
+	b.scenario.Connections = append(b.scenario.Connections, ConnectionSpec{
+		ID:    id,
+		From:  from,
+		Route: route,
+	})
+	return b
+}
+
+// Paths makes the declared connection use n redundant paths
+func (b *Builder) Paths(connID string, n int) *Builder {
+	for i := range b.scenario.Connections {
+		if b.scenario.Connections[i].ID == connID {
+			b.scenario.Connections[i].Paths = n
+		}
+	}
+	return b
+}
+
+func (b *Builder) Kill(at time.Duration, actorID string) *Builder {
+	return b.step(Step{At: at, Action: Kill, Actor: actorID})
+}
+
+func (b *Builder) Start(at time.Duration, actorID string) *Builder {
+	return b.step(Step{At: at, Action: Start, Actor: actorID})
+}
+
+// Request issues the request for the connection declared in Connection from another actor
+func (b *Builder) Request(at time.Duration, actorID, connID string) *Builder {
+	return b.step(Step{At: at, Action: Request, Actor: actorID, Connection: connID})
+}
+
+// KillNode kills all actors of the node at once
+func (b *Builder) KillNode(at time.Duration, node string) *Builder {
+	return b.step(Step{At: at, Action: KillNode, Node: node})
+}
+
+func (b *Builder) FreezeNode(at time.Duration, node string) *Builder {
+	return b.step(Step{At: at, Action: FreezeNode, Node: node})
+}
+
+func (b *Builder) UnfreezeNode(at time.Duration, node string) *Builder {
+	return b.step(Step{At: at, Action: UnfreezeNode, Node: node})
+}
+
+func (b *Builder) PartitionNode(at time.Duration, node string) *Builder {
+	return b.step(Step{At: at, Action: PartitionNode, Node: node})
+}
+
+func (b *Builder) ReconnectNode(at time.Duration, node string) *Builder {
+	return b.step(Step{At: at, Action: ReconnectNode, Node: node})
+}
+
+func (b *Builder) ExpectState(actorID, connID string, state sandbox.HealState, within time.Duration) *Builder {
+	b.scenario.Expectations = append(b.scenario.Expectations, Expectation{
+		Actor:      actorID,
+		Connection: connID,
+		State:      state,
+		Within:     within,
+	})
+	return b
+}
+
+func (b *Builder) ExpectClosed(actorID, connID string, within time.Duration) *Builder {
+	b.scenario.Expectations = append(b.scenario.Expectations, Expectation{
+		Actor:      actorID,
+		Connection: connID,
+		Closed:     true,
+		Within:     within,
+	})
+	return b
+}
+
+// Invariants makes the run fail if any of them is violated
+func (b *Builder) Invariants(invariants ...sandbox.Invariant) *Builder {
+	b.scenario.Invariants = append(b.scenario.Invariants, invariants...)
+	return b
+}
+
+func (b *Builder) Build() Scenario {
+	return b.scenario
+}
+
+func (b *Builder) step(s Step) *Builder {
+	b.scenario.Steps = append(b.scenario.Steps, s)
+	return b
+}
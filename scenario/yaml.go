@@ -0,0 +1,191 @@
+package scenario
+
+import (
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"time"
+)
+
+type yamlActor struct {
+	ID            string            `yaml:"id"`
+	Class         string            `yaml:"class"`
+	Node          string            `yaml:"node"`
+	NetworkHolder bool              `yaml:"networkHolder"`
+	Labels        map[string]string `yaml:"labels"`
+	Deferred      bool              `yaml:"deferred"`
+}
+
+type yamlConnection struct {
+	ID    string   `yaml:"id"`
+	From  string   `yaml:"from"`
+	Route []string `yaml:"route"`
+	Paths int      `yaml:"paths"`
+}
+
+type yamlStep struct {
+	At            time.Duration `yaml:"at"`
+	Kill          string        `yaml:"kill"`
+	Start         string        `yaml:"start"`
+	Request       string        `yaml:"request"`
+	Connection    string        `yaml:"connection"`
+	KillNode      string        `yaml:"killNode"`
+	FreezeNode    string        `yaml:"freezeNode"`
+	UnfreezeNode  string        `yaml:"unfreezeNode"`
+	PartitionNode string        `yaml:"partitionNode"`
+	ReconnectNode string        `yaml:"reconnectNode"`
+}
+
+// step returns the only action set in the YAML step
+func (s yamlStep) step() (Step, error) {
+	actions := []struct {
+		target string
+		step   Step
+	}{
+		{s.Kill, Step{Action: Kill, Actor: s.Kill}},
+		{s.Start, Step{Action: Start, Actor: s.Start}},
+		{s.Request, Step{Action: Request, Actor: s.Request, Connection: s.Connection}},
+		{s.KillNode, Step{Action: KillNode, Node: s.KillNode}},
+		{s.FreezeNode, Step{Action: FreezeNode, Node: s.FreezeNode}},
+		{s.UnfreezeNode, Step{Action: UnfreezeNode, Node: s.UnfreezeNode}},
+		{s.PartitionNode, Step{Action: PartitionNode, Node: s.PartitionNode}},
+		{s.ReconnectNode, Step{Action: ReconnectNode, Node: s.ReconnectNode}},
+	}
+
+	found := []Step{}
+	for _, a := range actions {
+		if a.target != "" {
+			a.step.At = s.At
+			found = append(found, a.step)
+		}
+	}
+	if len(found) != 1 {
+		return Step{}, fmt.Errorf("exactly one action has to be set, got %d", len(found))
+	}
+	return found[0], nil
+}
+
+type yamlExpectation struct {
+	Actor      string        `yaml:"actor"`
+	Connection string        `yaml:"connection"`
+	State      string        `yaml:"state"`
+	Closed     bool          `yaml:"closed"`
+	Within     time.Duration `yaml:"within"`
+}
+
+type yamlInvariant struct {
+	Name string `yaml:"name"`
+	// grace of ready-path and the propagation time of delete-propagates
+	Within time.Duration `yaml:"within"`
+}
+
+// invariant returns the built-in invariant, zero Within means the default one
+func (i yamlInvariant) invariant() (sandbox.Invariant, error) {
+	switch i.Name {
+	case "ready-path":
+		if i.Within == 0 {
+			i.Within = sandbox.DefaultReadyPathGrace
+		}
+		return sandbox.ReadyPath(i.Within), nil
+	case "no-connections-on-dead-actor":
+		return sandbox.NoConnectionsOnDeadActor(), nil
+	case "delete-propagates":
+		if i.Within == 0 {
+			i.Within = sandbox.DefaultDeletePropagation
+		}
+		return sandbox.DeletePropagates(i.Within), nil
+	}
+	return nil, fmt.Errorf("unknown invariant '%s'", i.Name)
+}
+
+type yamlScenario struct {
+	Name        string            `yaml:"name"`
+	Actors      []yamlActor       `yaml:"actors"`
+	Connections []yamlConnection  `yaml:"connections"`
+	Steps       []yamlStep        `yaml:"steps"`
+	Expect      []yamlExpectation `yaml:"expect"`
+	Invariants  []yamlInvariant   `yaml:"invariants"`
+}
+
+// ParseYAML builds Scenario from its YAML form:
+//
+//	name: dying-nsc
+//	actors:
+//	  - {id: nsc-1, class: nsc, node: master, networkHolder: true}
+//	connections:
+//	  - {id: conn-1, from: nsc-1, route: [nsc, nsmgr, nse]}
+//	steps:
+//	  - {at: 100ms, kill: nsc-1}
+//	  - {at: 100ms, killNode: node-2}
+//	  - {at: 200ms, request: nsc-2, connection: conn-1}
+//	expect:
+//	  - {actor: nsmgr-master, connection: conn-1, state: Ready, within: 5s}
+//	invariants:
+//	  - {name: ready-path, within: 6s}
+//	  - {name: no-connections-on-dead-actor}
+//	  - {name: delete-propagates, within: 1s}
+func ParseYAML(data []byte) (Scenario, error) {
+	doc := yamlScenario{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return Scenario{}, err
+	}
+
+	b := New(doc.Name)
+	for _, a := range doc.Actors {
+		meta := sandbox.Meta{
+			ID:            a.ID,
+			Class:         a.Class,
+			Node:          a.Node,
+			NetworkHolder: a.NetworkHolder,
+			Labels:        a.Labels,
+		}
+		if a.Deferred {
+			b.DeferredActor(meta)
+		} else {
+			b.Actors(meta)
+		}
+	}
+
+	for _, c := range doc.Connections {
+		b.Connection(c.ID, c.From, c.Route...).Paths(c.ID, c.Paths)
+	}
+
+	for i, s := range doc.Steps {
+		step, err := s.step()
+		if err != nil {
+			return Scenario{}, fmt.Errorf("step %d: %v", i, err)
+		}
+		b.step(step)
+	}
+
+	for i, e := range doc.Expect {
+		if e.Closed {
+			b.ExpectClosed(e.Actor, e.Connection, e.Within)
+			continue
+		}
+		state, err := sandbox.ParseHealState(e.State)
+		if err != nil {
+			return Scenario{}, fmt.Errorf("expectation %d: %v", i, err)
+		}
+		b.ExpectState(e.Actor, e.Connection, state, e.Within)
+	}
+
+	for i, inv := range doc.Invariants {
+		invariant, err := inv.invariant()
+		if err != nil {
+			return Scenario{}, fmt.Errorf("invariant %d: %v", i, err)
+		}
+		b.Invariants(invariant)
+	}
+
+	return b.Build(), nil
+}
+
+func LoadYAML(path string) (Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	return ParseYAML(data)
+}
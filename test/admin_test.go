@@ -0,0 +1,188 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/lobkovilya/healsandbox/admin"
+	"github.com/lobkovilya/healsandbox/repl"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAdminShell(g *WithT) repl.Shell {
+	shell := repl.NewShell(ioutil.Discard, repl.WithLogger(sandbox.NewCaptureLogger()))
+	for _, line := range []string{
+		"add nsc nsc-1 master",
+		"add nsmgr master",
+		"add nse icmp-responder-1 master",
+		"start nsc-1 nsmgr-master icmp-responder-1",
+		"request nsc-1 conn-1 nsc nsmgr nse",
+	} {
+		g.Expect(shell.Exec(line)).To(Succeed(), line)
+	}
+	return shell
+}
+
+// call sends the request the way the web UI does
+// and decodes the JSON response into v
+func call(g *WithT, method, url string, v interface{}) int {
+	return callWith(g, method, url, http.Header{"Content-Type": {"application/json"}}, v)
+}
+
+func callWith(g *WithT, method, url string, header http.Header, v interface{}) int {
+	request, err := http.NewRequest(method, url, nil)
+	g.Expect(err).To(BeNil())
+	request.Header = header
+	response, err := http.DefaultClient.Do(request)
+	g.Expect(err).To(BeNil())
+	defer response.Body.Close()
+	if v != nil {
+		g.Expect(json.NewDecoder(response.Body).Decode(v)).To(Succeed())
+	}
+	return response.StatusCode
+}
+
+func TestAdmin_State(t *testing.T) {
+	g := NewWithT(t)
+
+	shell := newAdminShell(g)
+	defer shell.Close()
+	server := httptest.NewServer(admin.NewHandler(shell))
+	defer server.Close()
+
+	var router sandbox.RouterState
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/router", &router)).To(Equal(http.StatusOK))
+	g.Expect(router.Actors).To(HaveLen(3))
+	g.Expect(router.Nodes).To(Equal([]sandbox.NodeState{{Name: "master"}}))
+
+	var cluster sandbox.ClusterState
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/actors", &cluster)).To(Equal(http.StatusOK))
+	g.Expect(cluster).To(HaveLen(3))
+
+	var conn sandbox.ConnectionState
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/actors/nsmgr-master/connections/conn-1", &conn)).To(Equal(http.StatusOK))
+	g.Expect(conn.State).To(Equal("Ready"))
+	g.Expect(conn.NextID).To(Equal("icmp-responder-1"))
+
+	errBody := map[string]string{}
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/actors/nsc-2", &errBody)).To(Equal(http.StatusNotFound))
+	g.Expect(errBody).To(HaveKeyWithValue("error", "unknown actor 'nsc-2'"))
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/actors/nsc-1/connections/conn-2", nil)).To(Equal(http.StatusNotFound))
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/actors/nsc-1/kill", nil)).To(Equal(http.StatusMethodNotAllowed))
+	g.Expect(call(g, http.MethodPost, server.URL+"/api/actors/nsc-1/restart", &errBody)).To(Equal(http.StatusConflict))
+	g.Expect(errBody).To(HaveKeyWithValue("error", "actor 'nsc-1' is alive, kill it first"))
+
+	g.Expect(call(g, http.MethodPost, server.URL+"/api/nodes/master/partition", &router)).To(Equal(http.StatusOK))
+	g.Expect(router.Nodes).To(Equal([]sandbox.NodeState{{Name: "master", Partitioned: true}}))
+	g.Expect(call(g, http.MethodPost, server.URL+"/api/nodes/master/reconnect", &router)).To(Equal(http.StatusOK))
+	g.Expect(call(g, http.MethodPost, server.URL+"/api/nodes/master/explode", nil)).To(Equal(http.StatusNotFound))
+
+	// pages of other origins can't change the cluster
+	g.Expect(callWith(g, http.MethodPost, server.URL+"/api/nodes/master/partition", http.Header{}, &errBody)).To(Equal(http.StatusUnsupportedMediaType))
+	g.Expect(callWith(g, http.MethodPost, server.URL+"/api/nodes/master/partition", http.Header{
+		"Content-Type": {"application/json"},
+		"Origin":       {"http://example.com"},
+	}, &errBody)).To(Equal(http.StatusForbidden))
+	g.Expect(errBody).To(HaveKeyWithValue("error", "origin http://example.com is not allowed"))
+	g.Expect(callWith(g, http.MethodPost, server.URL+"/api/actors/nsc-1/kill", http.Header{
+		"Content-Type": {"text/plain"},
+	}, nil)).To(Equal(http.StatusUnsupportedMediaType))
+	g.Expect(call(g, http.MethodGet, server.URL+"/api/router", &router)).To(Equal(http.StatusOK))
+	g.Expect(router.Nodes).To(Equal([]sandbox.NodeState{{Name: "master"}}))
+	g.Expect(callWith(g, http.MethodPost, server.URL+"/api/nodes/master/reconnect", http.Header{
+		"Content-Type": {"application/json"},
+		"Origin":       {server.URL},
+	}, nil)).To(Equal(http.StatusOK))
+}
+
+func TestAdmin_EventsAndFaults(t *testing.T) {
+	g := NewWithT(t)
+
+	shell := newAdminShell(g)
+	defer shell.Close()
+	server := httptest.NewServer(admin.NewHandler(shell))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/api/events?actor=nsmgr-master")
+	g.Expect(err).To(BeNil())
+	defer response.Body.Close()
+	g.Expect(response.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+	events := make(chan admin.Event, 10)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "data: ") {
+				continue
+			}
+			event := admin.Event{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &event) == nil {
+				events <- event
+			}
+		}
+		close(events)
+	}()
+
+	initial := <-events
+	g.Expect(initial.Actor).To(Equal("nsmgr-master"))
+	g.Expect(initial.Type).To(Equal("InitialTransfer"))
+	g.Expect(initial.Connections).To(HaveLen(1))
+
+	var nsc sandbox.ActorState
+	g.Expect(call(g, http.MethodPost, server.URL+"/api/actors/nsc-1/kill", &nsc)).To(Equal(http.StatusOK))
+	g.Expect(nsc.Alive).To(BeFalse())
+
+	update := <-events
+	g.Expect(update.Type).To(Equal("Update"))
+	g.Expect(update.Connections[0].ID).To(Equal("conn-1"))
+	g.Expect(update.Connections[0].State).To(Equal("WaitSrc"))
+	g.Expect(update.Connections[0].LastEvent).To(Equal("SrcDown"))
+
+	g.Expect(call(g, http.MethodPost, server.URL+"/api/actors/nsc-1/restart", &nsc)).To(Equal(http.StatusOK))
+	g.Expect(nsc.Alive).To(BeTrue())
+	g.Expect(nsc.Registered).To(BeTrue())
+}
+
+func TestAdmin_ServeLoopbackOnly(t *testing.T) {
+	g := NewWithT(t)
+
+	shell := repl.NewShell(ioutil.Discard)
+	defer shell.Close()
+
+	_, err := admin.Serve("10.0.0.1:8080", shell)
+	g.Expect(err).To(MatchError("admin endpoint '10.0.0.1:8080' is not on localhost"))
+
+	server, err := admin.Serve("127.0.0.1:0", shell)
+	g.Expect(err).To(BeNil())
+	defer server.Stop()
+	g.Expect(call(g, http.MethodGet, "http://"+server.Addr()+"/api/actors", nil)).To(Equal(http.StatusOK))
+}
+
+func TestAdmin_WebUI(t *testing.T) {
+	g := NewWithT(t)
+
+	shell := repl.NewShell(ioutil.Discard)
+	defer shell.Close()
+	server := httptest.NewServer(admin.NewHandler(shell))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/")
+	g.Expect(err).To(BeNil())
+	defer response.Body.Close()
+	g.Expect(response.StatusCode).To(Equal(http.StatusOK))
+	g.Expect(response.Header.Get("Content-Type")).To(HavePrefix("text/html"))
+	page, err := ioutil.ReadAll(response.Body)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(page)).To(ContainSubstring(`new EventSource("/api/events")`))
+	for _, state := range []sandbox.HealState{sandbox.Ready, sandbox.WaitSrc, sandbox.WaitDst, sandbox.Healing, sandbox.Closing} {
+		g.Expect(string(page)).To(ContainSubstring(state.String() + ": \"#"))
+	}
+
+	g.Expect(call(g, http.MethodGet, server.URL+"/index.html", nil)).To(Equal(http.StatusNotFound))
+	g.Expect(call(g, http.MethodPost, server.URL+"/", nil)).To(Equal(http.StatusMethodNotAllowed))
+}
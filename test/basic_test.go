@@ -35,7 +35,7 @@ func TestBasic_ConnectionEstablished(t *testing.T) {
 	forEach(actors).PrintState()
 	g.Expect(err).To(BeNil())
 	g.Expect(resp.LastActor).To(Equal("icmp-responder-1"))
-	g.Expect(forEach(actors).CheckNetworkConnectivity()).To(BeTrue())
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-id")).To(BeTrue())
 }
 
 func TestBasic_HealFailed(t *testing.T) {
@@ -62,11 +62,11 @@ func TestBasic_HealFailed(t *testing.T) {
 	})
 	g.Expect(err).To(BeNil())
 	g.Expect(resp.LastActor).To(Equal("icmp-responder-1"))
-	g.Expect(forEach(actors).CheckNetworkConnectivity()).To(BeTrue())
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-id")).To(BeTrue())
 
 	actors[1].Kill()
-	g.Expect(forEach(actors).CheckNetworkConnectivity()).To(BeTrue())
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-id")).To(BeTrue())
 
 	actors[2].Kill()
-	g.Expect(forEach(actors).CheckNetworkConnectivity()).To(BeFalse())
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-id")).To(BeFalse())
 }
@@ -40,7 +40,8 @@ func TestCleanup_DyingNSC(t *testing.T) {
 
 	nsc.Kill()
 	logrus.Info("NSC killed")
-	ctx, _ := context.WithTimeout(context.Background(), 25*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
 	err = forEach(actors[1:]).WaitClosed(ctx, "conn-1")
 	g.Expect(err).To(BeNil())
 }
@@ -48,8 +49,11 @@ func TestCleanup_DyingNSC(t *testing.T) {
 func TestCleanup_DyingNSMgr(t *testing.T) {
 	g := NewWithT(t)
 
+	recorder := sandbox.NewRecorder()
+	defer writeTimeline(t, recorder)
+
 	router := sandbox.NewRouter()
-	actors := actorsChain(router,
+	actors := actorsChainWith(router, []sandbox.Option{sandbox.WithRecorder(recorder)},
 		newNSC("nsc-1", "master"),
 		newNSMgr("master"),
 		newNSE("icmp-responder-1", "master"))
@@ -71,14 +75,15 @@ func TestCleanup_DyingNSMgr(t *testing.T) {
 	})
 	g.Expect(err).To(BeNil())
 
-	forEach(actors).WaitConnectionState("conn-1", sandbox.Ready)
+	forEach(actors).WaitConnectionState(t, "conn-1", sandbox.Ready)
 	forEach(actors).PrintState()
 
 	nsmgr := forEach(actors).FindByID("nsmgr-master")
 	nsmgr.Kill()
 
 	logrus.Info("NSMgr killed")
-	ctx, _ := context.WithTimeout(context.Background(), 25*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
 	err = forEach(single(forEach(actors).FindByID("icmp-responder-1"))).WaitClosed(ctx, "conn-1")
 	g.Expect(err).To(BeNil())
 
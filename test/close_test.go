@@ -0,0 +1,103 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func TestClose_InitiatedByNSC(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	closed := forEach(actors).WatchClosed("conn-1")
+	g.Expect(actors[0].Close("conn-1")).To(Succeed())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+
+	// close is idempotent
+	g.Expect(actors[0].Close("conn-1")).To(Succeed())
+}
+
+func TestClose_PartialFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	closed := forEach(actors[:2]).WatchClosed("conn-1")
+	actors[2].Kill()
+
+	err = actors[0].Close("conn-1")
+	g.Expect(err).To(BeAssignableToTypeOf(&sandbox.CloseError{}))
+	g.Expect(err.(*sandbox.CloseError).Failed).To(HaveKey("fw1"))
+	g.Expect(err.(*sandbox.CloseError).Failed).To(HaveLen(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+}
+
+func TestClose_PropagatesUpstream(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer func() {
+		logrus.Info("======= CLEANUP =======")
+		join()
+	}()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	closed := forEach(actors[:3]).WatchClosed("conn-1")
+	actors[3].Kill()
+
+	// forwarder gives up after WaitDstTimeout and closes the connection upstream
+	ctx, cancel := context.WithTimeout(context.Background(), 2*sandbox.WaitDstTimeout)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+}
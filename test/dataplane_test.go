@@ -0,0 +1,72 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestDataPlane_Probe(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	// nsmgr is not a part of the data plane
+	result := sandbox.Probe(router, actors[0], "conn-1")
+	g.Expect(result.Delivered).To(BeTrue(), result.String())
+	g.Expect(result.Hops).To(Equal([]string{"nsc-1", "fw1", "icmp-responder-1"}))
+
+	result = sandbox.Probe(router, actors[0], "conn-2")
+	g.Expect(result.Delivered).To(BeFalse())
+	g.Expect(result.DroppedAt).To(Equal("nsc-1"))
+}
+
+func TestDataPlane_PerConnection(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newForwarder("fw2", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	for connID, fw := range map[string]string{"conn-1": "fw1", "conn-2": "fw2"} {
+		_, err := actors[0].Request(sandbox.Request{
+			ConnectionID: connID,
+			Route:        []string{"nsc", "nsmgr", "id=" + fw, "nse"},
+		})
+		g.Expect(err).To(BeNil())
+	}
+
+	forEach(actors).FindByID("fw1").Kill()
+
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-1")).To(BeFalse())
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-2")).To(BeTrue())
+
+	result := sandbox.Probe(router, actors[0], "conn-1")
+	g.Expect(result.Delivered).To(BeFalse())
+	g.Expect(result.DroppedAt).To(Equal("fw1"))
+
+	result = sandbox.Probe(router, actors[0], "conn-2")
+	g.Expect(result.Delivered).To(BeTrue(), result.String())
+	g.Expect(result.Hops).To(Equal([]string{"nsc-1", "fw2", "icmp-responder-1"}))
+}
@@ -38,10 +38,10 @@ func TestHeal_DyingNSC(t *testing.T) {
 
 	nsc.Kill()
 	logrus.Info("NSC killed")
-	g.Expect(forEach(actors).CheckNetworkConnectivity()).To(BeFalse())
+	g.Expect(forEach(actors).CheckNetworkConnectivity(router, "conn-1")).To(BeFalse())
 
 	nsmgr := forEach(actors).FindByID("nsmgr-master")
-	forEach(single(nsmgr)).WaitConnectionState("conn-1", sandbox.WaitSrc)
+	forEach(single(nsmgr)).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
 	logrus.Info("nsmgr moved to healing")
 
 	newNSC := sandbox.NewActor(newNSC("nsc-2", "master"), router)
@@ -61,8 +61,8 @@ func TestHeal_DyingNSC(t *testing.T) {
 	g.Expect(err).To(BeNil())
 
 	resultChain := append(single(newNSC), actors[1:]...)
-	forEach(resultChain).WaitConnectionState("conn-1", sandbox.Ready)
-	g.Expect(forEach(resultChain).CheckNetworkConnectivity()).To(BeTrue())
+	forEach(resultChain).WaitConnectionState(t, "conn-1", sandbox.Ready)
+	g.Expect(forEach(resultChain).CheckNetworkConnectivity(router, "conn-1")).To(BeTrue())
 	forEach(append(single(newNSC), actors[1:]...)).PrintState()
 }
 
@@ -92,7 +92,7 @@ func TestHeal_DyingNSC(t *testing.T) {
 //	})
 //	g.Expect(err).To(BeNil())
 //
-//	forEach(actors).WaitConnectionState("conn-1", sandbox.Ready)
+//	forEach(actors).WaitConnectionState(t, "conn-1", sandbox.Ready)
 //	forEach(actors).PrintState()
 //
 //	nsmgr := forEach(actors).FindByID("nsmgr-master")
@@ -0,0 +1,197 @@
+package test
+
+import (
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/scenario"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestInvariants_Close(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	// the delete that hasn't reached the next hop is reported before the check
+	defer checkInvariants(t, actors,
+		sandbox.ReadyPath(sandbox.DefaultReadyPathGrace),
+		sandbox.NoConnectionsOnDeadActor(),
+		sandbox.DeletePropagates(50*time.Millisecond))()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	g.Expect(actors[0].Close("conn-1")).To(Succeed())
+	<-time.After(100 * time.Millisecond)
+}
+
+func TestInvariants_BrokenPath(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	checker := sandbox.NewInvariantChecker(sandbox.ReadyPath(100*time.Millisecond), sandbox.NoConnectionsOnDeadActor())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, a := range actors {
+		checker.Watch(a, stopCh)
+	}
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+	<-time.After(200 * time.Millisecond)
+	g.Expect(checker.Violations()).To(BeEmpty())
+
+	// nothing replaces the NSE, nsmgr waits for it with the Ready NSC
+	actors[2].Kill()
+	g.Eventually(checker.Violations, time.Second).Should(HaveLen(1))
+
+	v := checker.Violations()[0]
+	g.Expect(v.Invariant).To(Equal("ready-path"))
+	g.Expect(v.Actor).To(Equal("nsc-1"))
+	g.Expect(v.ConnectionID).To(Equal("conn-1"))
+	g.Expect(v.Message).To(ContainSubstring("hop nsmgr-master has conn-1 in State = WaitDst"))
+	g.Expect(killedIn(v.History, "icmp-responder-1")).To(BeTrue())
+	g.Expect(v.String()).To(ContainSubstring("history:"))
+	t.Log(v)
+}
+
+func killedIn(history []sandbox.HistoryEntry, actorID string) bool {
+	for _, e := range history {
+		if e.Actor == actorID && e.Event == "Killed" {
+			return true
+		}
+	}
+	return false
+}
+
+// noWaitSrc is violated by any connection waiting for the previous hop
+type noWaitSrc struct{}
+
+func (noWaitSrc) Name() string {
+	return "no-wait-src"
+}
+
+func (noWaitSrc) Check(view sandbox.ClusterView, now time.Time) []sandbox.Violation {
+	rv := []sandbox.Violation{}
+	for _, a := range view {
+		for _, c := range a.Connections {
+			if c.State == sandbox.WaitSrc.String() {
+				rv = append(rv, sandbox.Violation{
+					Actor:        a.ID,
+					ConnectionID: c.ID,
+					Message:      fmt.Sprintf("the previous hop %s is gone", c.FromID),
+				})
+			}
+		}
+	}
+	return rv
+}
+
+func TestInvariants_Scenario(t *testing.T) {
+	g := NewWithT(t)
+
+	build := func(invariants ...sandbox.Invariant) scenario.Scenario {
+		return scenario.New("heal-dying-nsc").
+			Actors(
+				newNSC("nsc-1", "master"),
+				newNSMgr("master"),
+				newNSE("icmp-responder-1", "master")).
+			DeferredActor(newNSC("nsc-2", "master")).
+			Connection("conn-1", "nsc-1", "nsc", "nsmgr", "nse").
+			Kill(0, "nsc-1").
+			Start(100*time.Millisecond, "nsc-2").
+			Request(200*time.Millisecond, "nsc-2", "conn-1").
+			ExpectState("nsc-2", "conn-1", sandbox.Ready, 5*time.Second).
+			ExpectState("icmp-responder-1", "conn-1", sandbox.Ready, 5*time.Second).
+			Invariants(invariants...).
+			Build()
+	}
+
+	report := scenario.Run(build(sandbox.DefaultInvariants()...))
+	t.Log(report)
+	g.Expect(report.Passed).To(BeTrue())
+
+	report = scenario.Run(build(noWaitSrc{}))
+	t.Log(report)
+	g.Expect(report.Passed).To(BeFalse())
+	g.Expect(report.Failures).To(HaveLen(1))
+	g.Expect(report.Failures[0]).To(ContainSubstring("invariant no-wait-src is violated on nsmgr-master, connection conn-1"))
+	g.Expect(report.Failures[0]).To(ContainSubstring("nsc-1                Killed"))
+}
+
+func TestInvariants_YAML(t *testing.T) {
+	g := NewWithT(t)
+
+	s, err := scenario.ParseYAML([]byte(`
+name: invariants
+invariants:
+  - {name: ready-path, within: 2s}
+  - {name: no-connections-on-dead-actor}
+  - {name: delete-propagates}
+`))
+	g.Expect(err).To(BeNil())
+	g.Expect(s.Invariants).To(HaveLen(3))
+	g.Expect(s.Invariants[0].Name()).To(Equal("ready-path"))
+
+	_, err = scenario.ParseYAML([]byte(`
+name: invalid
+invariants:
+  - {name: everything-is-fine}
+`))
+	g.Expect(err).ToNot(BeNil())
+}
+
+// flappingInvariant is broken while the flag is set
+type flappingInvariant struct {
+	broken *bool
+}
+
+func (flappingInvariant) Name() string { return "Flapping" }
+
+func (i flappingInvariant) Check(sandbox.ClusterView, time.Time) []sandbox.Violation {
+	if !*i.broken {
+		return nil
+	}
+	return []sandbox.Violation{{Actor: "nsc-1", ConnectionID: "conn-1", Message: "broken"}}
+}
+
+func TestInvariants_ReportedAgain(t *testing.T) {
+	g := NewWithT(t)
+
+	broken := true
+	checker := sandbox.NewInvariantChecker(flappingInvariant{&broken})
+
+	checker.Check()
+	checker.Check()
+	g.Expect(checker.Violations()).To(HaveLen(1))
+
+	// the violation cleared, it's reported again when it comes back
+	broken = false
+	checker.Check()
+	broken = true
+	checker.Check()
+	g.Expect(checker.Violations()).To(HaveLen(2))
+}
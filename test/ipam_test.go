@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestIPAM_Allocate(t *testing.T) {
+	g := NewWithT(t)
+
+	ipam, err := sandbox.NewIPAM("10.0.0.0/30", "10.0.1.0/30")
+	g.Expect(err).To(BeNil())
+
+	first, err := ipam.Allocate("conn-1", sandbox.IPContext{})
+	g.Expect(err).To(BeNil())
+	g.Expect(first).To(Equal(sandbox.IPContext{SrcIPAddr: "10.0.0.1/32", DstIPAddr: "10.0.0.2/32"}))
+
+	second, err := ipam.Allocate("conn-2", sandbox.IPContext{})
+	g.Expect(err).To(BeNil())
+	g.Expect(second).To(Equal(sandbox.IPContext{SrcIPAddr: "10.0.1.1/32", DstIPAddr: "10.0.1.2/32"}))
+
+	// addresses are kept by another path of the connection
+	g.Expect(ipam.Allocate(sandbox.PathID("conn-1", 1), first)).To(Equal(first))
+
+	// they are not given to another connection, and broadcast
+	// addresses are not allocated, so the prefixes are exhausted
+	_, err = ipam.Allocate("conn-3", first)
+	g.Expect(err).NotTo(BeNil())
+
+	ipam.Release("conn-1")
+	ipam.Release(sandbox.PathID("conn-1", 1))
+	g.Expect(ipam.Allocate("conn-4", first)).To(Equal(first))
+
+	_, err = sandbox.NewIPAM("10.0.0.0/33")
+	g.Expect(err).NotTo(BeNil())
+}
+
+func TestIPAM_PrefixSizes(t *testing.T) {
+	g := NewWithT(t)
+
+	// point-to-point prefix has no network and broadcast addresses
+	ipam, err := sandbox.NewIPAM("10.0.0.0/31")
+	g.Expect(err).To(BeNil())
+	g.Expect(ipam.Allocate("conn-1", sandbox.IPContext{})).To(Equal(sandbox.IPContext{SrcIPAddr: "10.0.0.0/32", DstIPAddr: "10.0.0.1/32"}))
+
+	ipam, err = sandbox.NewIPAM("0.0.0.0/0")
+	g.Expect(err).To(BeNil())
+	g.Expect(ipam.Allocate("conn-1", sandbox.IPContext{})).To(Equal(sandbox.IPContext{SrcIPAddr: "0.0.0.1/32", DstIPAddr: "0.0.0.2/32"}))
+}
+
+func healWithIPAM(g *WithT, opts ...sandbox.Option) (before, after sandbox.IPContext) {
+	ipam, err := sandbox.NewIPAM("172.16.0.0/24")
+	g.Expect(err).To(BeNil())
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	nsc := sandbox.NewActor(newNSC("nsc-1", "master"), router, append(opts, sandbox.WithMakeBeforeBreak())...)
+	actors := list(nsc,
+		sandbox.NewActor(nsmgrA, router),
+		sandbox.NewActor(nsmgrB, router),
+		sandbox.NewActor(newForwarder("fw1", "master"), router),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router, sandbox.WithIPAM(ipam)))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	conn, err := nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(conn.IPContext.IsEmpty()).To(BeFalse())
+
+	forEach(actors).FindByID("nsmgr-a").Kill()
+	return conn.IPContext, waitSwitched(nsc, "conn-1").Connection.IPContext
+}
+
+func TestIPAM_PreservedOnHeal(t *testing.T) {
+	g := NewWithT(t)
+
+	before, after := healWithIPAM(g)
+	g.Expect(after).To(Equal(before))
+}
+
+func TestIPAM_ReallocatedOnHeal(t *testing.T) {
+	g := NewWithT(t)
+
+	before, after := healWithIPAM(g, sandbox.WithAddressReallocation())
+	g.Expect(after.IsEmpty()).To(BeFalse())
+	g.Expect(after).NotTo(Equal(before))
+}
+
+func TestIPAM_ExhaustedOnHeal(t *testing.T) {
+	g := NewWithT(t)
+
+	// the only pair of addresses is kept by the broken path
+	ipam, err := sandbox.NewIPAM("172.16.0.0/30")
+	g.Expect(err).To(BeNil())
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	nsc := sandbox.NewActor(newNSC("nsc-1", "master"), router, sandbox.WithMakeBeforeBreak(), sandbox.WithAddressReallocation())
+	actors := list(nsc,
+		sandbox.NewActor(nsmgrA, router),
+		sandbox.NewActor(nsmgrB, router),
+		sandbox.NewActor(newForwarder("fw1", "master"), router),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router, sandbox.WithIPAM(ipam)))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err = nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+
+	// failed heals don't make the connection Ready, it's closed on timeout
+	closed := forEach(single(nsc)).WatchClosed("conn-1")
+	forEach(actors).FindByID("nsmgr-a").Kill()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*sandbox.WaitDstTimeout)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func leakCheckedChain(router sandbox.Router, registry sandbox.ResourceRegistry) []sandbox.Actor {
+	actors := []sandbox.Actor{}
+	for _, m := range []sandbox.Meta{
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"),
+	} {
+		actors = append(actors, sandbox.NewActor(m, router, sandbox.WithResourceRegistry(registry)))
+	}
+	return actors
+}
+
+func requestAndClose(g *WithT, actors []sandbox.Actor) {
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	closed := forEach(actors).WatchClosed("conn-1")
+	g.Expect(actors[0].Close("conn-1")).To(Succeed())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+}
+
+func TestLeaks_ReleasedOnClose(t *testing.T) {
+	g := NewWithT(t)
+
+	registry := sandbox.NewResourceRegistry()
+	router := sandbox.NewRouter()
+	actors := leakCheckedChain(router, registry)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	checker := sandbox.NewLeakChecker(registry)
+	for _, a := range actors {
+		checker.Watch(a, stopCh)
+	}
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-2",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+	// nsmgr is not a NetworkHolder
+	g.Expect(registry.List()).To(HaveLen(6))
+
+	requestAndClose(g, actors)
+
+	g.Consistently(checker.Leaks, 100*time.Millisecond).Should(BeEmpty())
+	g.Expect(registry.List()).To(HaveLen(6))
+}
+
+func TestLeaks_DetectedOnKill(t *testing.T) {
+	g := NewWithT(t)
+
+	registry := sandbox.NewResourceRegistry()
+	store := sandbox.NewMemoryConnectionStore()
+	router := sandbox.NewRouter()
+	fwOpts := []sandbox.Option{sandbox.WithResourceRegistry(registry), sandbox.WithConnectionStore(store)}
+	actors := list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router, sandbox.WithResourceRegistry(registry)),
+		sandbox.NewActor(newNSMgr("master"), router, sandbox.WithResourceRegistry(registry)),
+		sandbox.NewActor(newForwarder("fw1", "master"), router, fwOpts...),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router, sandbox.WithResourceRegistry(registry)))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	checker := sandbox.NewLeakChecker(registry)
+	for _, a := range actors {
+		checker.Watch(a, stopCh)
+	}
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+	g.Consistently(checker.Leaks, 100*time.Millisecond).Should(BeEmpty())
+
+	// the dead forwarder can't release what it has programmed
+	actors[2].Kill()
+	g.Eventually(checker.Leaks).Should(HaveLen(2))
+	g.Expect(checker.Leaks()[0].String()).To(Equal("fw1 interface 'nsm-conn-1' of connection 'conn-1'"))
+
+	// the next instance recovers the connection and takes them over
+	fw := sandbox.NewActor(newForwarder("fw1", "master"), router, fwOpts...)
+	checker.Watch(fw, stopCh)
+	joinFw := forEach(single(fw)).Run()
+	defer joinFw()
+	forEach(single(fw)).WaitRegistered()
+	g.Eventually(checker.Leaks).Should(BeEmpty())
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/scenario"
+	. "github.com/onsi/gomega"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger_Fields(t *testing.T) {
+	g := NewWithT(t)
+
+	logs := sandbox.NewCaptureLogger()
+	defer printLogsOnFailure(t, logs, "nsmgr-master")
+
+	router := sandbox.NewRouter()
+	actors := list()
+	for _, m := range []sandbox.Meta{
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newNSE("icmp-responder-1", "master"),
+	} {
+		actors = append(actors, sandbox.NewActor(m, router, sandbox.WithLogger(logs)))
+	}
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	nsmgr := forEach(actors).FindByID("nsmgr-master")
+	forEach(single(actors[0])).Kill()
+	forEach(single(nsmgr)).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
+
+	var transition *sandbox.LogEntry
+	for _, e := range logs.Filter("nsmgr-master") {
+		if e.Fields[sandbox.StateField] == "WaitSrc" {
+			e := e
+			transition = &e
+		}
+	}
+	g.Expect(transition).ToNot(BeNil())
+	g.Expect(transition.Level).To(Equal(sandbox.InfoLevel))
+	g.Expect(transition.Fields).To(Equal(sandbox.Fields{
+		sandbox.ActorIDField: "nsmgr-master",
+		sandbox.ClassField:   "nsmgr",
+		sandbox.NodeField:    "master",
+		sandbox.ConnIDField:  "conn-1",
+		sandbox.StateField:   "WaitSrc",
+		sandbox.EventField:   "SrcDown",
+	}))
+
+	for _, e := range logs.Filter("nsc-1") {
+		g.Expect(e.Fields).To(HaveKeyWithValue(sandbox.ActorIDField, "nsc-1"))
+	}
+	g.Expect(logs.Filter("nsc-1")).ToNot(BeEmpty())
+	g.Expect(logs.Filter("nsc-2")).To(BeEmpty())
+	g.Expect(len(logs.Filter())).To(BeNumerically(">", len(logs.Filter("nsc-1", "nsmgr-master"))))
+
+	var sb strings.Builder
+	g.Expect(logs.WriteTo(&sb, "icmp-responder-1")).To(Succeed())
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	g.Expect(lines).To(HaveLen(len(logs.Filter("icmp-responder-1"))))
+	for _, l := range lines {
+		g.Expect(l).To(ContainSubstring("actor_id=icmp-responder-1"))
+	}
+}
+
+func TestLogger_Scenario(t *testing.T) {
+	g := NewWithT(t)
+
+	logs := sandbox.NewCaptureLogger()
+	report := scenario.Run(scenario.New("logger").
+		Logger(logs).
+		Actors(
+			newNSC("nsc-1", "master"),
+			newNSMgr("master"),
+			newNSE("icmp-responder-1", "master")).
+		Connection("conn-1", "nsc-1", "nsc", "nsmgr", "nse").
+		ExpectState("nsc-1", "conn-1", sandbox.Ready, 5*time.Second).
+		Build())
+	g.Expect(report.Passed).To(BeTrue())
+
+	messages := map[string]bool{}
+	for _, e := range logs.Entries() {
+		messages[e.Message] = true
+	}
+	g.Expect(messages).To(HaveKey("scenario logger: cleanup"))
+
+	var started, accepted bool
+	for _, e := range logs.Filter("nsmgr-master") {
+		if e.Fields[sandbox.SupervisorIDField] == "logger" && e.Message == "ChildStarted" {
+			started = true
+		}
+		if e.Fields[sandbox.ConnIDField] == "conn-1" && strings.HasPrefix(e.Message, "request accepted") {
+			accepted = true
+		}
+	}
+	g.Expect(started).To(BeTrue())
+	g.Expect(accepted).To(BeTrue())
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitSwitched returns the connection once it's ready on the new path
+func waitSwitched(actor sandbox.Actor, connID string) *sandbox.ConnectionWrapper {
+	for event := range actor.Monitor() {
+		cw, ok := event.Connections[connID]
+		if ok && event.EventType != sandbox.Delete && cw.State == sandbox.Ready && cw.ActivePath() > 0 {
+			return cw
+		}
+	}
+	return nil
+}
+
+func TestMakeBeforeBreak_Replan(t *testing.T) {
+	g := NewWithT(t)
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	nsc := sandbox.NewActor(newNSC("nsc-1", "master"), router, sandbox.WithMakeBeforeBreak())
+	actors := append(single(nsc), actorsChain(router,
+		nsmgrA,
+		nsmgrB,
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+
+	forEach(actors).FindByID("nsmgr-a").Kill()
+
+	cw := waitSwitched(nsc, "conn-1")
+	g.Expect(cw.Outages()).To(HaveLen(1))
+	g.Expect(cw.Outages()[0].Duration()).To(BeNumerically(">", 0))
+
+	newSegment := list(
+		forEach(actors).FindByID("nsmgr-b"),
+		forEach(actors).FindByID("fw1"),
+		forEach(actors).FindByID("icmp-responder-1"))
+	forEach(newSegment).WaitConnectionState(t, sandbox.PathID("conn-1", 1), sandbox.Ready)
+}
+
+func TestMakeBeforeBreak_ClosesOldSegment(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	nsmgr := sandbox.NewActor(newNSMgr("master"), router, sandbox.WithMakeBeforeBreak())
+	actors := list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router),
+		nsmgr,
+		sandbox.NewActor(newForwarder("fw1", "master"), router),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	route := []string{"nsc", "nsmgr", "forwarder", "nse"}
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        route,
+	})
+	g.Expect(err).To(BeNil())
+
+	actors[0].Kill()
+	forEach(single(nsmgr)).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
+
+	newNSC := sandbox.NewActor(newNSC("nsc-2", "master"), router)
+	joinNSC := forEach(single(newNSC)).Run()
+	defer joinNSC()
+	forEach(single(newNSC)).WaitRegistered()
+
+	oldClosed := forEach(actors[2:]).WatchClosed("conn-1")
+	_, err = newNSC.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        route,
+	})
+	g.Expect(err).To(BeNil())
+
+	cw := waitSwitched(nsmgr, "conn-1")
+	g.Expect(cw.ActivePath()).To(Equal(1))
+	// the source was lost, the path downstream was usable all the time
+	g.Expect(cw.Outages()).To(BeEmpty())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(oldClosed(ctx)).To(Succeed())
+	forEach(actors[2:]).WaitConnectionState(t, sandbox.PathID("conn-1", 1), sandbox.Ready)
+}
+
+// holdInterceptor holds the first request of the connection until released
+type holdInterceptor struct {
+	connID    string
+	once      *sync.Once
+	heldCh    chan struct{}
+	releaseCh chan struct{}
+}
+
+func newHoldInterceptor(connID string) holdInterceptor {
+	return holdInterceptor{
+		connID:    connID,
+		once:      &sync.Once{},
+		heldCh:    make(chan struct{}),
+		releaseCh: make(chan struct{}),
+	}
+}
+
+func (i holdInterceptor) Request(_ sandbox.Meta, request *sandbox.Request) error {
+	if request.ConnectionID != i.connID {
+		return nil
+	}
+	i.once.Do(func() {
+		close(i.heldCh)
+		<-i.releaseCh
+	})
+	return nil
+}
+
+func (holdInterceptor) Response(sandbox.Meta, *sandbox.Connection) {}
+
+func TestMakeBeforeBreak_EventsDuringHeal(t *testing.T) {
+	g := NewWithT(t)
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	hold := newHoldInterceptor(sandbox.PathID("conn-1", 1))
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	nsc := sandbox.NewActor(newNSC("nsc-1", "master"), router, sandbox.WithMakeBeforeBreak())
+	actors := list(nsc,
+		sandbox.NewActor(nsmgrA, router),
+		sandbox.NewActor(nsmgrB, router, sandbox.WithInterceptors(hold)),
+		sandbox.NewActor(newForwarder("fw1", "master"), router),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	request := sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	}
+	_, err := nsc.Request(request)
+	g.Expect(err).To(BeNil())
+
+	forEach(actors).FindByID("nsmgr-a").Kill()
+	select {
+	case <-hold.heldCh:
+	case <-time.After(time.Second):
+		t.Fatal("the heal doesn't request the new path")
+	}
+
+	// the re-request queues its event while the healer is busy with the heal
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := nsc.Request(request)
+		errCh <- err
+	}()
+	<-time.After(100 * time.Millisecond)
+	close(hold.releaseCh)
+
+	select {
+	case err := <-errCh:
+		g.Expect(err).To(BeNil())
+	case <-time.After(time.Second):
+		t.Fatal("the healer is blocked")
+	}
+	forEach(single(nsc)).WaitConnectionState(t, "conn-1", sandbox.Ready)
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Heal(t *testing.T) {
+	g := NewWithT(t)
+
+	metrics := sandbox.NewMetrics(sandbox.NewMetricsRegistry())
+	router := sandbox.NewRouter(sandbox.WithRouterMetrics(metrics))
+	actors := list()
+	for _, m := range []sandbox.Meta{
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newNSE("icmp-responder-1", "master"),
+	} {
+		actors = append(actors, sandbox.NewActor(m, router, sandbox.WithMetrics(metrics)))
+	}
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+	_, err = actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-2",
+		Route:        []string{"nsc", "forwarder", "nse"},
+	})
+	g.Expect(err).NotTo(BeNil())
+
+	g.Expect(metrics.Requests.Value("nsc", "ok")).To(Equal(1.0))
+	g.Expect(metrics.Requests.Value("nsc", "error")).To(Equal(1.0))
+	g.Expect(metrics.Requests.Value("nse", "ok")).To(Equal(1.0))
+	g.Expect(metrics.RequestDuration.Value("nsc")).To(Equal(2.0))
+	g.Expect(metrics.RouterRegistrations.Value("nsmgr")).To(Equal(1.0))
+	g.Expect(metrics.RouterLookups.Value("none")).To(Equal(1.0))
+
+	// nsmgr waits for the source, the new one heals the connection
+	actors[0].Kill()
+	forEach(actors[1:2]).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
+
+	nsc := sandbox.NewActor(newNSC("nsc-2", "master"), router, sandbox.WithMetrics(metrics))
+	joinNSC := forEach(single(nsc)).Run()
+	defer joinNSC()
+	forEach(single(nsc)).WaitRegistered()
+	_, err = nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	g.Eventually(func() float64 {
+		return metrics.HealOutcomes.Value(sandbox.HealedOutcome)
+	}).Should(Equal(1.0))
+	g.Expect(metrics.HealTransitions.Value("Ready", "WaitSrc", "SrcDown")).To(Equal(1.0))
+	g.Expect(metrics.HealTransitions.Value("WaitSrc", "Healing", "SrcUp")).To(Equal(1.0))
+	g.Expect(metrics.HealStateDuration.Value("WaitSrc")).To(Equal(1.0))
+	g.Expect(metrics.HealStateDuration.Value("Healing")).To(Equal(1.0))
+
+	buf := bytes.Buffer{}
+	g.Expect(metrics.Registry.WriteText(&buf)).To(Succeed())
+	g.Expect(buf.String()).To(ContainSubstring("# TYPE healsandbox_heal_transitions_total counter\n"))
+	g.Expect(buf.String()).To(ContainSubstring(`healsandbox_heal_transitions_total{from="Ready",to="WaitSrc",event="SrcDown"} 1`))
+	g.Expect(buf.String()).To(ContainSubstring(`healsandbox_heal_state_duration_seconds_bucket{state="WaitSrc",le="+Inf"} 1`))
+}
+
+func TestMetrics_DroppedEvents(t *testing.T) {
+	g := NewWithT(t)
+
+	metrics := sandbox.NewMetrics(sandbox.NewMetricsRegistry())
+	router := sandbox.NewRouter()
+	nse := sandbox.NewActor(newNSE("icmp-responder-1", "master"), router, sandbox.WithMetrics(metrics))
+	join := forEach(single(nse)).Run()
+	defer join()
+	forEach(single(nse)).WaitRegistered()
+
+	// the subscriber never reads events
+	nse.Monitor()
+	g.Expect(metrics.MonitorSubscribers.Value("icmp-responder-1")).To(Equal(1.0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 120; i++ {
+		_, err := nse.Request(sandbox.Request{
+			ConnectionID: fmt.Sprintf("conn-%d", i),
+			Route:        []string{"nse"},
+		})
+		g.Expect(err).To(BeNil())
+		g.Expect(ctx.Err()).To(BeNil())
+	}
+	g.Expect(metrics.MonitorDroppedEvents.Value("icmp-responder-1")).To(BeNumerically(">=", 2))
+}
+
+func TestMetrics_Register(t *testing.T) {
+	g := NewWithT(t)
+
+	registry := sandbox.NewMetricsRegistry()
+	counter := registry.Counter("requests_total", "Requests.", "class")
+	g.Expect(registry.Counter("requests_total", "Requests.", "class")).To(BeIdenticalTo(counter))
+	g.Expect(func() { registry.Gauge("requests_total", "Requests.", "class") }).To(Panic())
+	g.Expect(func() { registry.Counter("requests_total", "Requests.", "class", "result") }).To(Panic())
+}
+
+func TestMetrics_Endpoint(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := sandbox.ServeMetrics("0.0.0.0:0", sandbox.NewMetricsRegistry())
+	g.Expect(err).NotTo(BeNil())
+
+	metrics := sandbox.NewMetrics(sandbox.NewMetricsRegistry())
+	metrics.Requests.Add(1, "nsc", "ok")
+	server, err := sandbox.ServeMetrics("127.0.0.1:0", metrics.Registry)
+	g.Expect(err).To(BeNil())
+	defer func() {
+		g.Expect(server.Stop()).To(Succeed())
+	}()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", server.Addr()))
+	g.Expect(err).To(BeNil())
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	g.Expect(err).To(BeNil())
+	g.Expect(string(body)).To(ContainSubstring(`healsandbox_requests_total{class="nsc",result="ok"} 1`))
+}
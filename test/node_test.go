@@ -0,0 +1,172 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/scenario"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestNode_Kill(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(2).Build()
+	router := sandbox.NewRouter()
+	actors := actorsChain(router, topo.Metas()...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	route, err := topo.Route("nsc-1", "icmp-responder-2")
+	g.Expect(err).To(BeNil())
+	_, err = forEach(actors).FindByID("nsc-1").Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        route,
+	})
+	g.Expect(err).To(BeNil())
+
+	killed := router.KillNode("node-2")
+	g.Expect(killed).To(HaveLen(3))
+	for _, a := range killed {
+		g.Expect(a.GetMeta().Node).To(Equal("node-2"))
+		g.Expect(a.IsAlive()).To(BeFalse())
+	}
+
+	forEach(single(forEach(actors).FindByID("fw-node-1-1"))).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+
+	_, err = forEach(actors).FindByID("nsc-1").Request(sandbox.Request{
+		ConnectionID: "conn-2",
+		Route:        route,
+	})
+	g.Expect(err).ToNot(BeNil())
+}
+
+func TestNode_Freeze(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(2).Build()
+	router := sandbox.NewRouter()
+	actors := actorsChain(router, topo.Metas()...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	route, err := topo.Route("nsc-1", "icmp-responder-2")
+	g.Expect(err).To(BeNil())
+	_, err = forEach(actors).FindByID("nsc-1").Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        route,
+	})
+	g.Expect(err).To(BeNil())
+
+	router.FreezeNode("node-2")
+	g.Expect(router.Reachable("node-1", "node-2")).To(BeFalse())
+	g.Expect(router.Reachable("node-2", "node-1")).To(BeTrue())
+	forEach(single(forEach(actors).FindByID("fw-node-1-1"))).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+
+	nse := forEach(actors).FindByID("icmp-responder-2")
+	g.Expect(nse.IsAlive()).To(BeTrue())
+	_, err = nse.Request(sandbox.Request{
+		ConnectionID: "conn-2",
+		Route:        []string{"nse"},
+	})
+	g.Expect(err).ToNot(BeNil())
+
+	router.UnfreezeNode("node-2")
+	g.Expect(router.Reachable("node-1", "node-2")).To(BeTrue())
+}
+
+func TestNode_Partition(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(2).Build()
+	router := sandbox.NewRouter()
+	actors := actorsChain(router, topo.Metas()...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	route, err := topo.Route("nsc-1", "icmp-responder-2")
+	g.Expect(err).To(BeNil())
+	_, err = forEach(actors).FindByID("nsc-1").Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        route,
+	})
+	g.Expect(err).To(BeNil())
+
+	router.PartitionNode("node-1")
+	forEach(single(forEach(actors).FindByID("fw-node-1-1"))).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+	forEach(single(forEach(actors).FindByID("nsmgr-node-2"))).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
+
+	router.ReconnectNode("node-1")
+	g.Expect(router.Reachable("node-1", "node-2")).To(BeTrue())
+}
+
+// nsmgr on node-2 loses both source and destination at once
+func TestNode_CorrelatedFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(1).Build()
+	router := sandbox.NewRouter()
+	actors := actorsChain(router, topo.Metas()...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := forEach(actors).FindByID("nsc-1").Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route: []string{
+			sandbox.Hop(topology.NSCClass, "node-1"),
+			sandbox.Hop(topology.NSMgrClass, "node-2"),
+			sandbox.Hop(topology.ForwarderClass, "node-1"),
+			sandbox.Hop(topology.NSEClass, "node-1"),
+		},
+	})
+	g.Expect(err).To(BeNil())
+
+	monitor := forEach(actors).FindByID("nsmgr-node-2").Monitor()
+	router.KillNode("node-1")
+
+	// connection is closed without waiting for timeouts
+	timeout := time.After(sandbox.WaitDstTimeout / 2)
+	for {
+		select {
+		case event := <-monitor:
+			if _, ok := event.Connections["conn-1"]; ok && event.EventType == sandbox.Delete {
+				return
+			}
+		case <-timeout:
+			t.Fatal("connection is not closed")
+		}
+	}
+}
+
+func TestNode_Scenario(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(1).Build()
+	s := scenario.New("correlated-failure").
+		Actors(topo.Metas()...).
+		Connection("conn-1", "nsc-1",
+			sandbox.Hop(topology.NSCClass, "node-1"),
+			sandbox.Hop(topology.NSMgrClass, "node-2"),
+			sandbox.Hop(topology.ForwarderClass, "node-1"),
+			sandbox.Hop(topology.NSEClass, "node-1")).
+		KillNode(0, "node-1").
+		ExpectClosed("nsmgr-node-2", "conn-1", sandbox.WaitDstTimeout/2).
+		Build()
+
+	parsed, err := scenario.ParseYAML([]byte(`
+name: correlated-failure
+steps:
+  - {at: 0s, killNode: node-1}
+`))
+	g.Expect(err).To(BeNil())
+	g.Expect(parsed.Steps).To(Equal(s.Steps))
+
+	report := scenario.Run(s)
+	t.Log(report)
+	g.Expect(report.Passed).To(BeTrue())
+}
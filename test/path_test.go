@@ -0,0 +1,55 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestPath_ReplacedOnHeal(t *testing.T) {
+	g := NewWithT(t)
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		nsmgrA,
+		nsmgrB,
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	nsc := forEach(actors).FindByID("nsc-1")
+	conn, err := nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+	before := conn.Hops()
+	g.Expect(before).To(Equal([]string{"nsc-1", "nsmgr-a", "fw1", "icmp-responder-1"}))
+
+	// every actor on the path knows it
+	for _, id := range before {
+		g.Expect(hopsOf(forEach(actors).FindByID(id), "conn-1")()).To(Equal(before))
+	}
+
+	forEach(actors).FindByID("nsmgr-a").Kill()
+
+	after := []string{"nsc-1", "nsmgr-b", "fw1", "icmp-responder-1"}
+	for _, id := range after {
+		g.Eventually(hopsOf(forEach(actors).FindByID(id), "conn-1")).Should(Equal(after))
+	}
+
+	diff := sandbox.ComparePaths(before, hopsOf(nsc, "conn-1")())
+	g.Expect(diff.Changed()).To(BeTrue())
+	g.Expect(diff.Removed).To(Equal([]string{"nsmgr-a"}))
+	g.Expect(diff.Added).To(Equal([]string{"nsmgr-b"}))
+	g.Expect(diff.Kept).To(Equal([]string{"nsc-1", "fw1", "icmp-responder-1"}))
+}
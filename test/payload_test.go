@@ -0,0 +1,135 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"sync/atomic"
+	"testing"
+)
+
+// labelInterceptor marks requests with the actor that passed them and
+// names the interface of the connection on the way back
+type labelInterceptor struct{}
+
+func (labelInterceptor) Request(self sandbox.Meta, request *sandbox.Request) error {
+	if request.Labels == nil {
+		request.Labels = map[string]string{}
+	}
+	request.Labels["nsmgr"] = self.ID
+	return nil
+}
+
+func (labelInterceptor) Response(self sandbox.Meta, conn *sandbox.Connection) {
+	conn.Mechanism.Parameters = map[string]string{"name": "nsm-" + self.ID}
+}
+
+// countInterceptor counts requests the actor accepted
+type countInterceptor struct {
+	requests *int32
+}
+
+func (i countInterceptor) Request(sandbox.Meta, *sandbox.Request) error {
+	atomic.AddInt32(i.requests, 1)
+	return nil
+}
+
+func (countInterceptor) Response(sandbox.Meta, *sandbox.Connection) {}
+
+func payloadChain(router sandbox.Router, fwMechanisms ...string) []sandbox.Actor {
+	return list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router),
+		sandbox.NewActor(newNSMgr("master"), router, sandbox.WithInterceptors(labelInterceptor{})),
+		sandbox.NewActor(newForwarder("fw1", "master"), router, sandbox.WithMechanisms(fwMechanisms...)),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router,
+			sandbox.WithMechanisms(sandbox.MemifMechanism, sandbox.KernelMechanism)))
+}
+
+func TestPayload_Negotiation(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := payloadChain(router, sandbox.KernelMechanism, sandbox.VxlanMechanism)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	conn, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		MechanismPreferences: []sandbox.Mechanism{
+			{Type: sandbox.MemifMechanism},
+			{Type: sandbox.KernelMechanism},
+		},
+		Labels: map[string]string{"app": "web"},
+	})
+	g.Expect(err).To(BeNil())
+
+	// the forwarder doesn't support memif
+	g.Expect(conn.Mechanism.Type).To(Equal(sandbox.KernelMechanism))
+	g.Expect(conn.Mechanism.Parameters).To(Equal(map[string]string{"name": "nsm-nsmgr-master"}))
+	g.Expect(conn.Labels).To(Equal(map[string]string{"app": "web", "nsmgr": "nsmgr-master"}))
+
+	names := []string{}
+	tokens := map[string]bool{}
+	for _, s := range conn.Segments {
+		names = append(names, s.Name)
+		tokens[s.Token] = true
+	}
+	g.Expect(names).To(Equal([]string{"nsc-1", "nsmgr-master", "fw1", "icmp-responder-1"}))
+	g.Expect(tokens).To(HaveLen(4))
+}
+
+func TestPayload_NoCommonMechanism(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := payloadChain(router, sandbox.VxlanMechanism)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		MechanismPreferences: []sandbox.Mechanism{
+			{Type: sandbox.KernelMechanism},
+		},
+	})
+	g.Expect(err).To(MatchError(ContainSubstring("supports none of mechanisms")))
+}
+
+func TestPayload_ReRequest(t *testing.T) {
+	g := NewWithT(t)
+
+	var requests int32
+	router := sandbox.NewRouter()
+	actors := list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router),
+		sandbox.NewActor(newNSMgr("master"), router, sandbox.WithInterceptors(countInterceptor{&requests})),
+		sandbox.NewActor(newForwarder("fw1", "master"), router),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	request := sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		MechanismPreferences: []sandbox.Mechanism{
+			{Type: sandbox.KernelMechanism, Parameters: map[string]string{"mtu": "1500"}},
+		},
+	}
+	conn, err := actors[0].Request(request)
+	g.Expect(err).To(BeNil())
+	g.Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+
+	// hops don't share parameters with the caller
+	request.MechanismPreferences[0].Parameters["mtu"] = "9000"
+	conn.Mechanism.Parameters["mtu"] = "9000"
+
+	// interceptors see the request of the existing connection as well
+	conn, err = actors[0].Request(request)
+	g.Expect(err).To(BeNil())
+	g.Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+	g.Expect(conn.Mechanism.Parameters).To(Equal(map[string]string{"mtu": "1500"}))
+}
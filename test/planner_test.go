@@ -0,0 +1,79 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestPlanner_CrossNodeRoute(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(2).Build()
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	actors := actorsChain(router, topo.Metas()...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	nsc := forEach(actors).FindByID("nsc-1")
+	route, err := router.PlanRoute(nsc.GetMeta(), "id=icmp-responder-2")
+	g.Expect(err).To(BeNil())
+	g.Expect(route).To(Equal([]string{
+		"id=nsc-1",
+		"class=nsmgr,node=node-1",
+		"class=forwarder,node=node-1",
+		"class=nsmgr,node=node-2",
+		"class=forwarder,node=node-2",
+		"id=icmp-responder-2",
+	}))
+
+	// endpoint on the same node is preferred
+	resp, err := nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.LastActor).To(Equal("icmp-responder-1"))
+
+	router.KillNode("node-1")
+	_, err = router.PlanRoute(nsc.GetMeta(), "nse")
+	g.Expect(err).ToNot(BeNil())
+}
+
+func TestPlanner_ReplanOnHeal(t *testing.T) {
+	g := NewWithT(t)
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		nsmgrA,
+		nsmgrB,
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	nsc := forEach(actors).FindByID("nsc-1")
+	_, err := nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+
+	forEach(actors).FindByID("nsmgr-a").Kill()
+
+	resultChain := list(nsc,
+		forEach(actors).FindByID("nsmgr-b"),
+		forEach(actors).FindByID("fw1"),
+		forEach(actors).FindByID("icmp-responder-1"))
+	forEach(resultChain).WaitConnectionState(t, "conn-1", sandbox.Ready)
+	forEach(resultChain).PrintState()
+}
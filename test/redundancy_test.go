@@ -0,0 +1,167 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func redundantChain(router sandbox.Router) []sandbox.Actor {
+	return actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newForwarder("fw1", "master"),
+		newForwarder("fw2", "master"),
+		newNSE("icmp-responder-1", "master"))
+}
+
+// redundantPeers returns next peers of the active and the standby path
+// of the connection on the actor, actors register in any order
+func redundantPeers(router sandbox.Router, a sandbox.Actor, connID string) (active, standby sandbox.Actor) {
+	conn, _ := a.State().Connection(connID)
+	return router.FindActor(conn.NextID), router.FindActor(conn.Standby[1])
+}
+
+func TestRedundancy_Failover(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := redundantChain(router)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		Paths:        2,
+	})
+	g.Expect(err).To(BeNil())
+
+	failoverCh := make(chan []sandbox.HealState, 1)
+	monitor := actors[1].Monitor()
+	go func() {
+		states := []sandbox.HealState{}
+		for event := range monitor {
+			cw, ok := event.Connections["conn-1"]
+			if !ok || event.EventType == sandbox.Delete {
+				continue
+			}
+			states = append(states, cw.State)
+			if cw.ActivePath() == 1 {
+				failoverCh <- states
+				return
+			}
+		}
+	}()
+
+	active, _ := redundantPeers(router, actors[1], "conn-1")
+	active.Kill()
+
+	select {
+	case states := <-failoverCh:
+		g.Expect(states).NotTo(ContainElement(sandbox.WaitDst))
+	case <-time.After(time.Second):
+		t.Fatal("no failover to the standby path")
+	}
+
+	closed := forEach(actors[:2]).WatchClosed("conn-1")
+	standbyClosed := forEach(single(actors[4])).WatchClosed("conn-1.path-1")
+	g.Expect(actors[0].Close("conn-1")).To(Succeed())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+	g.Expect(standbyClosed(ctx)).To(Succeed())
+}
+
+func TestRedundancy_NoStandbyLeft(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := redundantChain(router)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		Paths:        2,
+	})
+	g.Expect(err).To(BeNil())
+
+	actors[3].Kill()
+	actors[2].Kill()
+
+	forEach(single(actors[1])).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+}
+
+func TestRedundancy_DisjointPaths(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newNSMgr("node-1"),
+		newForwarder("fw1", "master"),
+		newForwarder("fw2", "node-1"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		Paths:        2,
+	})
+	g.Expect(err).To(BeNil())
+
+	nse := actors[5]
+	active, standby := hopsOf(nse, "conn-1")(), hopsOf(nse, "conn-1.path-1")()
+	g.Expect(active).To(HaveLen(4))
+	g.Expect(standby).To(HaveLen(4))
+	// paths share only the source and the destination
+	for _, hop := range active[1:3] {
+		g.Expect(standby).NotTo(ContainElement(hop))
+	}
+}
+
+func TestRedundancy_StandbyDown(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := redundantChain(router)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+		Paths:        2,
+	})
+	g.Expect(err).To(BeNil())
+
+	standby := func() map[int]string {
+		conn, _ := actors[1].State().Connection("conn-1")
+		return conn.Standby
+	}
+	g.Expect(standby()).To(HaveLen(1))
+
+	// the standby is dropped as soon as its peer is down,
+	// the active path keeps working
+	active, standbyPeer := redundantPeers(router, actors[1], "conn-1")
+	standbyPeer.Kill()
+	g.Eventually(standby, time.Second).Should(BeEmpty())
+	conn, _ := actors[1].State().Connection("conn-1")
+	g.Expect(conn.State).To(Equal(sandbox.Ready.String()))
+	g.Expect(conn.ActivePath).To(Equal(0))
+
+	active.Kill()
+	forEach(single(actors[1])).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func refreshChain(router sandbox.Router, refresh time.Duration) []sandbox.Actor {
+	const ttl = 300 * time.Millisecond
+
+	nsc := []sandbox.Option{}
+	if refresh > 0 {
+		nsc = append(nsc, sandbox.WithRefresh(refresh))
+	}
+	return list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router, nsc...),
+		sandbox.NewActor(newNSMgr("master"), router, sandbox.WithConnectionTTL(ttl)),
+		sandbox.NewActor(newForwarder("fw1", "master"), router, sandbox.WithConnectionTTL(ttl)),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router, sandbox.WithConnectionTTL(ttl)))
+}
+
+func TestRefresh_KeepsConnection(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := refreshChain(router, 100*time.Millisecond)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(forEach(actors).WaitClosed(ctx, "conn-1")).To(Equal(context.DeadlineExceeded))
+}
+
+func TestRefresh_ExpiresConnection(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := refreshChain(router, 0)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	closed := forEach(actors).WatchClosed("conn-1")
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	// the expired connection is closed downstream and upstream
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+}
+
+func TestRefresh_RequestsDuringKill(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := refreshChain(router, 0)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	request := sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "forwarder", "nse"},
+	}
+	_, err := actors[0].Request(request)
+	g.Expect(err).To(BeNil())
+
+	// re-requests join healers that ask for the Meta of the actor being killed
+	doneCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			_, _ = actors[0].Request(request)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	forEach(actors).FindByID("fw1").Kill()
+	forEach(actors).FindByID("nsmgr-master").Kill()
+	close(stopCh)
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests are stuck")
+	}
+}
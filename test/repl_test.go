@@ -0,0 +1,135 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lobkovilya/healsandbox/repl"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is written by watchers of the shell concurrently with the test
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+// Take returns the output written so far and resets the buffer
+func (b *syncBuffer) Take() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	defer b.buf.Reset()
+	return b.buf.String()
+}
+
+func TestREPL_Incident(t *testing.T) {
+	g := NewWithT(t)
+
+	out := &syncBuffer{}
+	shell := repl.NewShell(out, repl.WithLogger(sandbox.NewCaptureLogger()))
+	defer shell.Close()
+
+	for _, line := range []string{
+		"# the single node cluster",
+		"add nsc nsc-1 master",
+		"add nsmgr master",
+		"add nse icmp-responder-1 master",
+		"start nsc-1 nsmgr-master icmp-responder-1",
+		"watch nsmgr-master",
+		"request nsc-1 conn-1 nsc nsmgr nse",
+	} {
+		g.Expect(shell.Exec(line)).To(Succeed(), line)
+	}
+	g.Eventually(out.Take).Should(ContainSubstring("conn-1 established, hops [nsc-1 nsmgr-master icmp-responder-1]"))
+
+	g.Expect(shell.Exec("kill nsc-1")).To(Succeed())
+	g.Eventually(out.Take).Should(ContainSubstring("[nsmgr-master] Update conn-1 State = WaitSrc"))
+
+	// the new instance recovers the connection from the store
+	g.Expect(shell.Exec("restart nsc-1")).To(Succeed())
+	g.Expect(shell.Exec("request nsc-1 conn-1 nsc nsmgr nse")).To(Succeed())
+	g.Eventually(out.Take).Should(ContainSubstring("[nsmgr-master] Update conn-1 State = Ready"))
+
+	g.Expect(shell.Exec("unwatch nsmgr-master")).To(Succeed())
+	out.Take()
+	g.Expect(shell.Exec("state json")).To(Succeed())
+	var state sandbox.ClusterState
+	g.Expect(json.Unmarshal([]byte(out.Take()), &state)).To(Succeed())
+	nsc, ok := state.Actor("nsc-1")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(nsc.Alive).To(BeTrue())
+	_, ok = nsc.Connection("conn-1")
+	g.Expect(ok).To(BeTrue())
+
+	g.Expect(shell.Exec("close nsc-1 conn-1")).To(Succeed())
+	g.Expect(out.Take()).To(Equal("conn-1 closed\n"))
+	g.Expect(shell.Exec("state")).To(Succeed())
+	g.Expect(strings.Contains(out.Take(), "conn-1 ")).To(BeFalse())
+}
+
+func TestREPL_Errors(t *testing.T) {
+	g := NewWithT(t)
+
+	out := &syncBuffer{}
+	shell := repl.NewShell(out, repl.WithLogger(sandbox.NewCaptureLogger()))
+	defer shell.Close()
+
+	g.Expect(shell.Exec("")).To(Succeed())
+	g.Expect(shell.Exec("frobnicate")).To(MatchError("unknown command 'frobnicate', see 'help'"))
+	g.Expect(shell.Exec("kill nsc-1")).To(MatchError("unknown actor 'nsc-1'"))
+	g.Expect(shell.Exec("add nsc nsc-1")).To(MatchError(HavePrefix("usage: add")))
+	g.Expect(shell.Exec("add nsc nsc-1 master")).To(Succeed())
+	g.Expect(shell.Exec("add nsc nsc-1 master")).To(MatchError("actor 'nsc-1' already exists"))
+	g.Expect(shell.Exec("restart nsc-1")).To(MatchError("actor 'nsc-1' is alive, kill it first"))
+	g.Expect(shell.Exec("request nsc-1 conn-1")).To(MatchError(HavePrefix("usage: request")))
+	g.Expect(shell.Exec("quit")).To(Equal(repl.ErrQuit))
+
+	// errors don't stop the script
+	shell.Run(strings.NewReader("frobnicate\nhelp\nquit\nhelp\n"), false)
+	output := out.Take()
+	g.Expect(output).To(ContainSubstring("error: unknown command 'frobnicate'"))
+	g.Expect(strings.Count(output, "print this help")).To(Equal(1))
+}
+
+func TestREPL_ConcurrentRestart(t *testing.T) {
+	g := NewWithT(t)
+
+	shell := repl.NewShell(&syncBuffer{}, repl.WithLogger(sandbox.NewCaptureLogger()))
+	defer shell.Close()
+	for _, line := range []string{"add nsc nsc-1 master", "start nsc-1", "kill nsc-1"} {
+		g.Expect(shell.Exec(line)).To(Succeed(), line)
+	}
+
+	errs := make(chan error, 2)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- shell.Restart("nsc-1")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// one instance replaces the killed actor, the other restart fails
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			g.Expect(err).To(MatchError("actor 'nsc-1' is alive, kill it first"))
+			failed++
+		}
+	}
+	g.Expect(failed).To(Equal(1))
+	g.Expect(shell.Actors()).To(HaveLen(1))
+	g.Expect(shell.Actors()[0].IsAlive()).To(BeTrue())
+}
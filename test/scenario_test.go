@@ -0,0 +1,87 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/scenario"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestScenario_HealDyingNSC(t *testing.T) {
+	g := NewWithT(t)
+
+	s := scenario.New("heal-dying-nsc").
+		Actors(
+			newNSC("nsc-1", "master"),
+			newNSMgr("master"),
+			newNSE("icmp-responder-1", "master")).
+		DeferredActor(newNSC("nsc-2", "master")).
+		Connection("conn-1", "nsc-1", "nsc", "nsmgr", "nse").
+		Kill(0, "nsc-1").
+		Start(100*time.Millisecond, "nsc-2").
+		Request(200*time.Millisecond, "nsc-2", "conn-1").
+		ExpectState("nsc-2", "conn-1", sandbox.Ready, 5*time.Second).
+		ExpectState("nsmgr-master", "conn-1", sandbox.Ready, 5*time.Second).
+		ExpectState("icmp-responder-1", "conn-1", sandbox.Ready, 5*time.Second).
+		ExpectClosed("nsc-1", "conn-1", 5*time.Second).
+		Build()
+
+	loaded, err := scenario.LoadYAML("scenarios/heal_dying_nsc.yaml")
+	g.Expect(err).To(BeNil())
+	g.Expect(loaded).To(Equal(s))
+
+	report := scenario.Run(s)
+	t.Log(report)
+	g.Expect(report.Passed).To(BeTrue())
+	g.Expect(report.Timeline).ToNot(BeEmpty())
+}
+
+func TestScenario_Failed(t *testing.T) {
+	g := NewWithT(t)
+
+	report := scenario.Run(scenario.New("not-closed").
+		Actors(
+			newNSC("nsc-1", "master"),
+			newNSMgr("master"),
+			newNSE("icmp-responder-1", "master")).
+		Connection("conn-1", "nsc-1", "nsc", "nsmgr", "nse").
+		ExpectClosed("nsmgr-master", "conn-1", 100*time.Millisecond).
+		Build())
+
+	t.Log(report)
+	g.Expect(report.Passed).To(BeFalse())
+	g.Expect(report.Failures).To(HaveLen(1))
+}
+
+func TestScenario_InvalidYAML(t *testing.T) {
+	g := NewWithT(t)
+
+	_, err := scenario.ParseYAML([]byte(`
+name: invalid
+steps:
+  - {at: 1s, kill: nsc-1, start: nsc-2}
+`))
+	g.Expect(err).ToNot(BeNil())
+}
+
+func TestScenario_InvalidStart(t *testing.T) {
+	g := NewWithT(t)
+
+	build := func() *scenario.Builder {
+		return scenario.New("invalid-start").
+			Actors(
+				newNSC("nsc-1", "master"),
+				newNSMgr("master"),
+				newNSE("icmp-responder-1", "master")).
+			DeferredActor(newNSC("nsc-2", "master"))
+	}
+
+	report := scenario.Run(build().Start(0, "nsc-1").Build())
+	g.Expect(report.Passed).To(BeFalse())
+	g.Expect(report.Failures).To(Equal([]string{"step 0: actor 'nsc-1' is not deferred"}))
+
+	report = scenario.Run(build().Start(0, "nsc-2").Start(100*time.Millisecond, "nsc-2").Build())
+	g.Expect(report.Passed).To(BeFalse())
+	g.Expect(report.Failures).To(Equal([]string{"step 1: actor 'nsc-2' is started twice"}))
+}
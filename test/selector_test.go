@@ -0,0 +1,69 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestSelector_SameNodeAsClient(t *testing.T) {
+	g := NewWithT(t)
+
+	fw1 := newForwarder("fw-1", "node-1")
+	fw1.Labels = map[string]string{"mechanism": "kernel"}
+	fw2 := newForwarder("fw-2", "node-2")
+	fw2.Labels = map[string]string{"mechanism": "kernel"}
+	fw3 := newForwarder("fw-3", "node-2")
+	fw3.Labels = map[string]string{"mechanism": "memif"}
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "node-2"),
+		newNSMgr("node-1"),
+		newNSMgr("node-2"),
+		fw1,
+		fw2,
+		fw3,
+		newNSE("icmp-responder-1", "node-1"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route: []string{
+			"nsc",
+			"class=nsmgr,node=$src.node",
+			"class=forwarder,node=$prev.node,mechanism!=memif",
+			"nse",
+		},
+	})
+	g.Expect(err).To(BeNil())
+
+	for _, id := range []string{"nsmgr-node-2", "fw-2"} {
+		event := <-forEach(actors).FindByID(id).Monitor()
+		g.Expect(event.Connections).To(HaveKey("conn-1"), id)
+	}
+	for _, id := range []string{"nsmgr-node-1", "fw-1", "fw-3"} {
+		event := <-forEach(actors).FindByID(id).Monitor()
+		g.Expect(event.Connections).To(BeEmpty(), id)
+	}
+}
+
+func TestSelector_Parse(t *testing.T) {
+	g := NewWithT(t)
+
+	s, err := sandbox.ParseSelector("class=forwarder, node=$src.node")
+	g.Expect(err).To(BeNil())
+	g.Expect(s.String()).To(Equal("class=forwarder,node=$src.node"))
+
+	s, err = sandbox.ParseSelector("nse")
+	g.Expect(err).To(BeNil())
+	g.Expect(s.String()).To(Equal("class=nse"))
+
+	_, err = sandbox.ParseSelector("class=forwarder,node")
+	g.Expect(err).ToNot(BeNil())
+
+	_, err = sandbox.ParseSelector("node=$dst.node")
+	g.Expect(err).ToNot(BeNil())
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestState_Snapshot(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router,
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	before := sandbox.Snapshot(actors...)
+	g.Expect(before).To(HaveLen(3))
+	g.Expect(before[0].ID).To(Equal("icmp-responder-1"))
+
+	nsmgr, ok := before.Actor("nsmgr-master")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(nsmgr.Alive).To(BeTrue())
+	g.Expect(nsmgr.Registered).To(BeTrue())
+	conn, ok := nsmgr.Connection("conn-1")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(conn.State).To(Equal("Ready"))
+	g.Expect(conn.FromID).To(Equal("nsc-1"))
+	g.Expect(conn.NextID).To(Equal("icmp-responder-1"))
+	g.Expect(conn.Transitions).To(Equal(0))
+	g.Expect(conn.LastEvent).To(BeEmpty())
+	g.Expect(conn.Timers).To(BeEmpty())
+
+	forEach(actors).FindByID("nsc-1").Kill()
+	forEach(single(actors[1])).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
+
+	after := sandbox.Snapshot(actors...)
+	nsc, _ := after.Actor("nsc-1")
+	g.Expect(nsc.Alive).To(BeFalse())
+	nsmgr, _ = after.Actor("nsmgr-master")
+	conn, _ = nsmgr.Connection("conn-1")
+	g.Expect(conn.State).To(Equal("WaitSrc"))
+	g.Expect(conn.LastEvent).To(Equal("SrcDown"))
+	g.Expect(conn.Timers).To(HaveLen(1))
+	g.Expect(conn.Timers[0].Name).To(Equal(sandbox.WaitSrcTimer))
+	g.Expect(conn.Timers[0].Deadline).To(BeTemporally("~", time.Now().Add(sandbox.WaitSrcTimeout), time.Second))
+
+	// JSON is stable across the round trip
+	var first bytes.Buffer
+	g.Expect(after.WriteJSON(&first)).To(Succeed())
+	var decoded sandbox.ClusterState
+	g.Expect(json.Unmarshal(first.Bytes(), &decoded)).To(Succeed())
+	var second bytes.Buffer
+	g.Expect(decoded.WriteJSON(&second)).To(Succeed())
+	g.Expect(second.String()).To(Equal(first.String()))
+
+	var yaml bytes.Buffer
+	g.Expect(after.WriteYAML(&yaml)).To(Succeed())
+	g.Expect(yaml.String()).To(ContainSubstring("state: WaitSrc"))
+	g.Expect(yaml.String()).To(ContainSubstring("last_event: SrcDown"))
+
+	var table bytes.Buffer
+	g.Expect(after.WriteTable(&table)).To(Succeed())
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	g.Expect(lines).To(HaveLen(4))
+	g.Expect(lines[0]).To(HavePrefix("ACTOR"))
+	g.Expect(strings.Fields(lines[2])).To(Equal([]string{
+		"nsc-1", "nsc", "master", "false", "true", "-", "-", "-", "-", "-",
+	}))
+	g.Expect(lines[3]).To(ContainSubstring("WaitSrc in "))
+}
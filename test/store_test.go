@@ -0,0 +1,135 @@
+package test
+
+import (
+	"context"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_RecoverAfterRestart(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "healsandbox")
+	g.Expect(err).To(BeNil())
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nsmgr-master.log")
+	store, err := sandbox.NewFileConnectionStore(path)
+	g.Expect(err).To(BeNil())
+
+	router := sandbox.NewRouter()
+	nsmgr := sandbox.NewActor(newNSMgr("master"), router, sandbox.WithConnectionStore(store))
+	actors := list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router),
+		nsmgr,
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router))
+
+	join := forEach(actors).Run()
+	defer func() {
+		logrus.Info("======= CLEANUP =======")
+		join()
+	}()
+	forEach(actors).WaitRegistered()
+
+	_, err = actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route: []string{
+			"nsc",
+			"nsmgr",
+			"nse",
+		},
+	})
+	g.Expect(err).To(BeNil())
+
+	nsmgr.Kill()
+	logrus.Info("NSMgr killed")
+
+	records, err := sandbox.ReadConnectionLog(path)
+	g.Expect(err).To(BeNil())
+	g.Expect(records).To(HaveLen(1))
+	g.Expect(records[0].Connection.ID).To(Equal("conn-1"))
+	g.Expect(records[0].FromID).To(Equal("nsc-1"))
+	g.Expect(records[0].NextID).To(Equal("icmp-responder-1"))
+
+	restored, err := sandbox.NewFileConnectionStore(path)
+	g.Expect(err).To(BeNil())
+	newNSMgr := sandbox.NewActor(newNSMgr("master"), router, sandbox.WithConnectionStore(restored))
+	joinNSMgr := forEach(single(newNSMgr)).Run()
+	defer joinNSMgr()
+	forEach(single(newNSMgr)).WaitRegistered()
+
+	event := <-newNSMgr.Monitor()
+	g.Expect(event.EventType).To(Equal(sandbox.InitialTransfer))
+	g.Expect(event.Connections).To(HaveKey("conn-1"))
+	g.Expect(event.Connections["conn-1"].State).To(Equal(sandbox.Ready))
+}
+
+func TestStore_RecoverState(t *testing.T) {
+	g := NewWithT(t)
+
+	store := sandbox.NewMemoryConnectionStore()
+	g.Expect(store.Store(sandbox.ConnectionRecord{
+		Connection: sandbox.Connection{ID: "conn-1"},
+		State:      sandbox.WaitDst,
+		Route:      []string{"nsc", "nsmgr", "nse"},
+		Current:    1,
+		NextID:     "icmp-responder-1",
+	})).To(Succeed())
+
+	router := sandbox.NewRouter()
+	nsmgr := sandbox.NewActor(newNSMgr("master"), router, sandbox.WithConnectionStore(store))
+	actors := single(nsmgr)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	// the connection keeps waiting for the next peer after restart,
+	// the endpoint isn't started so the heal can't finish it
+	forEach(actors).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+}
+
+func TestStore_RecoverMissingNext(t *testing.T) {
+	g := NewWithT(t)
+
+	store := sandbox.NewMemoryConnectionStore()
+	g.Expect(store.Store(sandbox.ConnectionRecord{
+		Connection: sandbox.Connection{ID: "conn-1"},
+		State:      sandbox.Ready,
+		Route:      []string{"nsc", "nsmgr", "nse"},
+		Current:    1,
+		NextID:     "icmp-responder-1",
+	})).To(Succeed())
+
+	router := sandbox.NewRouter()
+	nsmgr := sandbox.NewActor(newNSMgr("master"), router, sandbox.WithConnectionStore(store))
+	actors := single(nsmgr)
+	closed := forEach(actors).WatchClosed("conn-1")
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	// the next peer is gone, the connection isn't ready without it
+	forEach(actors).WaitConnectionState(t, "conn-1", sandbox.WaitDst)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*sandbox.WaitDstTimeout)
+	defer cancel()
+	g.Expect(closed(ctx)).To(Succeed())
+}
+
+func TestStore_MemoryStore(t *testing.T) {
+	g := NewWithT(t)
+
+	store := sandbox.NewMemoryConnectionStore()
+	g.Expect(store.Store(sandbox.ConnectionRecord{Connection: sandbox.Connection{ID: "conn-2"}})).To(Succeed())
+	g.Expect(store.Store(sandbox.ConnectionRecord{Connection: sandbox.Connection{ID: "conn-1"}})).To(Succeed())
+	g.Expect(store.Delete("conn-2")).To(Succeed())
+
+	records, err := store.Load()
+	g.Expect(err).To(BeNil())
+	g.Expect(records).To(HaveLen(1))
+	g.Expect(records[0].Connection.ID).To(Equal("conn-1"))
+}
@@ -0,0 +1,188 @@
+package test
+
+import (
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+	"time"
+)
+
+func TestSupervisor_OneForOne(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	sup := sandbox.NewSupervisor("master", sandbox.SupervisorPolicy{
+		Strategy: sandbox.OneForOne,
+		Backoff:  10 * time.Millisecond,
+	},
+		permanent(router, newNSMgr("master")),
+		permanent(router, newNSE("icmp-responder-1", "master")))
+	events := sup.Events()
+
+	join := runSupervisor(sup)
+	defer join()
+
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildStarted, "nsmgr-master")).To(Succeed())
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildStarted, "icmp-responder-1")).To(Succeed())
+
+	nse := sup.Child("icmp-responder-1")
+	sup.Child("nsmgr-master").Kill()
+
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildDied, "nsmgr-master")).To(Succeed())
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildRestarted, "nsmgr-master")).To(Succeed())
+
+	nsmgr := sup.Child("nsmgr-master").(sandbox.Actor)
+	g.Expect(nsmgr.IsAlive()).To(BeTrue())
+	g.Expect(sup.Child("icmp-responder-1")).To(BeIdenticalTo(nse))
+	forEach(single(nsmgr)).WaitRegistered()
+
+	nsc := sandbox.NewActor(newNSC("nsc-1", "master"), router)
+	joinNSC := forEach(single(nsc)).Run()
+	defer joinNSC()
+	forEach(single(nsc)).WaitRegistered()
+
+	resp, err := nsc.Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route: []string{
+			"nsc",
+			"nsmgr",
+			"nse",
+		},
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.LastActor).To(Equal("icmp-responder-1"))
+}
+
+func TestSupervisor_OneForAll(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	sup := sandbox.NewSupervisor("master", sandbox.SupervisorPolicy{
+		Strategy: sandbox.OneForAll,
+	},
+		permanent(router, newNSMgr("master")),
+		permanent(router, newForwarder("fw1", "master")))
+	events := sup.Events()
+
+	join := runSupervisor(sup)
+	defer join()
+
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildStarted, "fw1")).To(Succeed())
+
+	fw := sup.Child("fw1")
+	sup.Child("nsmgr-master").Kill()
+
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildRestarted, "nsmgr-master")).To(Succeed())
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildRestarted, "fw1")).To(Succeed())
+	g.Expect(fw.IsAlive()).To(BeFalse())
+	g.Expect(sup.Child("fw1").IsAlive()).To(BeTrue())
+}
+
+func TestSupervisor_RestartLimit(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	sup := sandbox.NewSupervisor("master", sandbox.SupervisorPolicy{
+		Strategy:    sandbox.OneForOne,
+		MaxRestarts: 1,
+		Window:      time.Minute,
+	},
+		permanent(router, newNSMgr("master")))
+	events := sup.Events()
+
+	join := runSupervisor(sup)
+	defer join()
+
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildStarted, "nsmgr-master")).To(Succeed())
+	sup.Child("nsmgr-master").Kill()
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildRestarted, "nsmgr-master")).To(Succeed())
+	sup.Child("nsmgr-master").Kill()
+	g.Expect(waitSupervisorEvent(events, sandbox.RestartLimitReached, "nsmgr-master")).To(Succeed())
+
+	select {
+	case <-sup.Liveness():
+	case <-time.After(time.Second):
+		t.Fatal("supervisor is still alive")
+	}
+}
+
+func TestSupervisor_SlowSubscriber(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	sup := sandbox.NewSupervisor("master", sandbox.SupervisorPolicy{
+		Strategy: sandbox.OneForOne,
+	},
+		permanent(router, newNSMgr("master")))
+	// nobody reads it, the supervisor must not wait for it
+	sup.Events()
+	unsubscribed := sup.Events()
+	sup.Unsubscribe(unsubscribed)
+	events := sup.Events()
+
+	join := runSupervisor(sup)
+	defer join()
+
+	g.Expect(waitSupervisorEvent(events, sandbox.ChildStarted, "nsmgr-master")).To(Succeed())
+	for i := 0; i < 60; i++ {
+		sup.Child("nsmgr-master").Kill()
+		g.Expect(waitSupervisorEvent(events, sandbox.ChildRestarted, "nsmgr-master")).To(Succeed())
+	}
+	g.Expect(unsubscribed).To(BeEmpty())
+}
+
+func TestSupervisor_StartChildDuringKill(t *testing.T) {
+	g := NewWithT(t)
+
+	router := sandbox.NewRouter()
+	sup := sandbox.NewSupervisor("master", sandbox.SupervisorPolicy{})
+	join := runSupervisor(sup)
+
+	started := make(chan sandbox.Child, 50)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for i := 0; i < cap(started); i++ {
+			meta := newNSMgr(fmt.Sprintf("node-%d", i))
+			sup.StartChild(sandbox.ChildSpec{
+				ID: meta.ID,
+				Start: func() sandbox.Child {
+					a := sandbox.NewActor(meta, router)
+					started <- a
+					return a
+				},
+				Restart: sandbox.Permanent,
+			})
+		}
+	}()
+	join()
+	<-doneCh
+	close(started)
+
+	for c := range started {
+		g.Expect(c.IsAlive()).To(BeFalse())
+	}
+}
+
+func permanent(router sandbox.Router, meta sandbox.Meta) sandbox.ChildSpec {
+	return sandbox.ChildSpec{
+		ID:      meta.ID,
+		Start:   func() sandbox.Child { return sandbox.NewActor(meta, router) },
+		Restart: sandbox.Permanent,
+	}
+}
+
+func waitSupervisorEvent(events <-chan sandbox.SupervisorEvent, eventType sandbox.SupervisorEventType, childID string) error {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.EventType == eventType && event.ChildID == childID {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("no %v event for %s", eventType, childID)
+		}
+	}
+}
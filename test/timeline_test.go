@@ -0,0 +1,107 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lobkovilya/healsandbox/sandbox"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+type chromeTrace struct {
+	TraceEvents []struct {
+		Name string            `json:"name"`
+		Cat  string            `json:"cat"`
+		Ph   string            `json:"ph"`
+		Ts   int64             `json:"ts"`
+		Dur  int64             `json:"dur"`
+		TID  int               `json:"tid"`
+		Args map[string]string `json:"args"`
+	} `json:"traceEvents"`
+}
+
+func TestTimeline_ChromeTrace(t *testing.T) {
+	g := NewWithT(t)
+
+	recorder := sandbox.NewRecorder()
+	defer writeTimeline(t, recorder)
+
+	router := sandbox.NewRouter()
+	actors := actorsChainWith(router, []sandbox.Option{sandbox.WithRecorder(recorder)},
+		newNSC("nsc-1", "master"),
+		newNSMgr("master"),
+		newNSE("icmp-responder-1", "master"))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	actors[0].Kill()
+	forEach(single(actors[1])).WaitConnectionState(t, "conn-1", sandbox.WaitSrc)
+	g.Eventually(func() int { return len(recorder.Records()) }).Should(BeNumerically(">=", 7))
+
+	var buf bytes.Buffer
+	g.Expect(recorder.WriteChromeTrace(&buf)).To(Succeed())
+	trace := chromeTrace{}
+	g.Expect(json.Unmarshal(buf.Bytes(), &trace)).To(Succeed())
+
+	// lanes are named by actors
+	lanes := map[string]int{}
+	for _, e := range trace.TraceEvents {
+		if e.Ph == "M" {
+			lanes[e.Args["name"]] = e.TID
+		}
+	}
+	g.Expect(lanes).To(Equal(map[string]int{"icmp-responder-1": 1, "nsc-1": 2, "nsmgr-master": 3}))
+
+	find := func(tid int, name string) (int64, bool) {
+		for _, e := range trace.TraceEvents {
+			if e.TID == tid && e.Name == name && e.Args["state"] != "Ready" {
+				return e.Ts, true
+			}
+		}
+		return 0, false
+	}
+
+	for _, lane := range lanes {
+		_, ok := find(lane, "request")
+		g.Expect(ok).To(BeTrue())
+	}
+	killed, ok := find(lanes["nsc-1"], "killed")
+	g.Expect(ok).To(BeTrue())
+	transition, ok := find(lanes["nsmgr-master"], "Ready -> WaitSrc")
+	g.Expect(ok).To(BeTrue())
+	update, ok := find(lanes["nsmgr-master"], "Update conn-1")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(transition).To(BeNumerically(">=", killed))
+	g.Expect(update).To(BeNumerically(">=", transition))
+
+	for _, e := range trace.TraceEvents {
+		switch e.Cat {
+		case sandbox.SpanRecord:
+			g.Expect(e.Ph).To(Equal("X"))
+			g.Expect(e.Args).To(HaveKeyWithValue("connection_id", "conn-1"))
+		case sandbox.KillRecord, sandbox.MonitorRecord:
+			g.Expect(e.Ph).To(Equal("i"))
+		}
+	}
+
+	// records are ordered by time
+	records := recorder.Records()
+	for i := 1; i < len(records); i++ {
+		g.Expect(records[i].Start.Before(records[i-1].Start)).To(BeFalse())
+	}
+	for _, r := range records {
+		g.Expect(r.End == nil).To(Equal(r.Kind != sandbox.SpanRecord))
+	}
+
+	// instant records have no end
+	buf.Reset()
+	g.Expect(recorder.WriteJSON(&buf)).To(Succeed())
+	g.Expect(buf.String()).ToNot(ContainSubstring("0001-01-01"))
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestTopology_CrossNodeConnection(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().
+		Nodes(2).
+		Forwarders(2).
+		NSCs(2).
+		NSEs(2).
+		Build()
+	g.Expect(topo.Nodes).To(HaveLen(2))
+	g.Expect(topo.Metas()).To(HaveLen(10))
+
+	router := sandbox.NewRouter()
+	actors := actorsChain(router, topo.Metas()...)
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	route, err := topo.Route("nsc-1", "icmp-responder-2")
+	g.Expect(err).To(BeNil())
+	g.Expect(route).To(Equal([]string{
+		"class=nsc,node=node-1",
+		"class=nsmgr,node=node-1",
+		"class=forwarder,node=node-1",
+		"class=nsmgr,node=node-2",
+		"class=forwarder,node=node-2",
+		"class=nse,node=node-2",
+	}))
+
+	resp, err := forEach(actors).FindByID("nsc-1").Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        route,
+	})
+	g.Expect(err).To(BeNil())
+	g.Expect(resp.LastActor).To(Equal("icmp-responder-2"))
+
+	path, err := topo.Path("nsc-1", "icmp-responder-2")
+	g.Expect(err).To(BeNil())
+	g.Expect(path).To(Equal([]string{"nsc-1", "nsmgr-node-1", "fw-node-1-1", "nsmgr-node-2", "fw-node-2-1", "icmp-responder-2"}))
+	for _, id := range path {
+		event := <-forEach(actors).FindByID(id).Monitor()
+		g.Expect(event.Connections).To(HaveKey("conn-1"), id)
+	}
+	event := <-forEach(actors).FindByID("fw-node-1-2").Monitor()
+	g.Expect(event.Connections).To(BeEmpty())
+}
+
+func TestTopology_SameNodeRoute(t *testing.T) {
+	g := NewWithT(t)
+
+	topo := topology.NewBuilder().Nodes(2).NSCs(1).NSEs(1).Build()
+
+	route, err := topo.Route("nsc-1", "icmp-responder-1")
+	g.Expect(err).To(BeNil())
+	g.Expect(route).To(Equal([]string{
+		sandbox.Hop("nsc", "node-1"),
+		sandbox.Hop("nsmgr", "node-1"),
+		sandbox.Hop("forwarder", "node-1"),
+		sandbox.Hop("nse", "node-1"),
+	}))
+
+	_, err = topo.Route("nsc-1", "nsmgr-node-1")
+	g.Expect(err).ToNot(BeNil())
+}
+
+func TestTopology_NoNodes(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(func() { topology.NewBuilder().Nodes(0).NSCs(1).Build() }).To(Panic())
+	g.Expect(func() { topology.NewBuilder().Nodes(-1) }).To(Panic())
+}
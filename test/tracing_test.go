@@ -0,0 +1,138 @@
+package test
+
+import (
+	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// teeExporter passes spans to every exporter
+type teeExporter []sandbox.SpanExporter
+
+func (t teeExporter) Export(span sandbox.Span) {
+	for _, e := range t {
+		e.Export(span)
+	}
+}
+
+func spanOf(spans []sandbox.Span, name, actorID string) (sandbox.Span, bool) {
+	for _, s := range spans {
+		if s.Name == name && s.Actor == actorID {
+			return s, true
+		}
+	}
+	return sandbox.Span{}, false
+}
+
+func TestTracing_RequestHops(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "tracing")
+	g.Expect(err).To(BeNil())
+	defer os.RemoveAll(dir)
+	file, err := sandbox.NewJSONExporter(filepath.Join(dir, "spans.json"), sandbox.DefaultLogger)
+	g.Expect(err).To(BeNil())
+
+	memory := sandbox.NewMemoryExporter()
+	exporter := sandbox.WithSpanExporter(teeExporter{memory, file})
+
+	router := sandbox.NewRouter()
+	actors := list(
+		sandbox.NewActor(newNSC("nsc-1", "master"), router, exporter),
+		sandbox.NewActor(newNSMgr("master"), router, exporter),
+		sandbox.NewActor(newNSE("icmp-responder-1", "master"), router, exporter))
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err = actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Route:        []string{"nsc", "nsmgr", "nse"},
+	})
+	g.Expect(err).To(BeNil())
+
+	nsc, _ := spanOf(memory.Spans(), "request", "nsc-1")
+	nsmgr, _ := spanOf(memory.Spans(), "request", "nsmgr-master")
+	nse, _ := spanOf(memory.Spans(), "request", "icmp-responder-1")
+	g.Expect(memory.Trace(nsc.TraceID)).To(HaveLen(3))
+	g.Expect(nsc.ParentID).To(BeEmpty())
+	g.Expect(nsmgr.ParentID).To(Equal(nsc.SpanID))
+	g.Expect(nse.ParentID).To(Equal(nsmgr.SpanID))
+	g.Expect(nsmgr.Attributes).To(HaveKeyWithValue("hop", "1"))
+	g.Expect(nsc.Start.After(nse.Start)).To(BeFalse())
+	g.Expect(nsc.End.Before(nse.End)).To(BeFalse())
+
+	g.Expect(file.Close()).To(Succeed())
+	spans, err := sandbox.ReadSpans(filepath.Join(dir, "spans.json"))
+	g.Expect(err).To(BeNil())
+	g.Expect(spans).To(HaveLen(3))
+	g.Expect(spans[0].SpanID).To(Equal(nse.SpanID))
+}
+
+func TestTracing_Heal(t *testing.T) {
+	g := NewWithT(t)
+
+	nsmgrA := newNSMgr("master")
+	nsmgrA.ID = "nsmgr-a"
+	nsmgrB := newNSMgr("master")
+	nsmgrB.ID = "nsmgr-b"
+
+	memory := sandbox.NewMemoryExporter()
+	router := sandbox.NewRouter(sandbox.WithRoutePolicy(topology.RoutePolicy))
+	actors := list()
+	for _, m := range []sandbox.Meta{
+		newNSC("nsc-1", "master"),
+		nsmgrA,
+		nsmgrB,
+		newForwarder("fw1", "master"),
+		newNSE("icmp-responder-1", "master"),
+	} {
+		actors = append(actors, sandbox.NewActor(m, router, sandbox.WithSpanExporter(memory)))
+	}
+	join := forEach(actors).Run()
+	defer join()
+	forEach(actors).WaitRegistered()
+
+	_, err := actors[0].Request(sandbox.Request{
+		ConnectionID: "conn-1",
+		Dst:          "nse",
+	})
+	g.Expect(err).To(BeNil())
+
+	forEach(actors).FindByID("nsmgr-a").Kill()
+
+	var heal sandbox.Span
+	g.Eventually(func() bool {
+		var ok bool
+		heal, ok = spanOf(memory.Spans(), "heal", "nsc-1")
+		return ok
+	}).Should(BeTrue())
+	g.Expect(heal.Attributes).To(HaveKeyWithValue("cause", "DstDown"))
+	g.Expect(heal.Attributes).To(HaveKeyWithValue("outcome", "Ready"))
+
+	// the re-request is a part of the heal trace
+	trace := memory.Trace(heal.TraceID)
+	byID := map[string]sandbox.Span{}
+	transitions := []string{}
+	for _, s := range trace {
+		byID[s.SpanID] = s
+		if s.Name == "transition" {
+			g.Expect(s.ParentID).To(Equal(heal.SpanID))
+			transitions = append(transitions, s.Attributes["from"]+"->"+s.Attributes["to"])
+		}
+	}
+	g.Expect(transitions).To(Equal([]string{"Ready->WaitDst", "WaitDst->Healing", "Healing->Ready"}))
+
+	nsmgr, ok := spanOf(trace, "request", "nsmgr-b")
+	g.Expect(ok).To(BeTrue())
+	parent := byID[nsmgr.ParentID]
+	g.Expect(parent.Name).To(Equal("transition"))
+	g.Expect(parent.Attributes).To(HaveKeyWithValue("to", "Healing"))
+	fw, ok := spanOf(trace, "request", "fw1")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(fw.ParentID).To(Equal(nsmgr.SpanID))
+}
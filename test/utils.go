@@ -2,10 +2,15 @@ package test
 
 import (
 	"context"
-	"fmt"
 	"github.com/lobkovilya/healsandbox/sandbox"
+	"github.com/lobkovilya/healsandbox/topology"
 	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"testing"
+	"time"
 )
 
 type forEach []sandbox.Actor
@@ -18,21 +23,42 @@ func list(actors ...sandbox.Actor) []sandbox.Actor {
 	return actors
 }
 
+// Run starts actors under the supervisor that never restarts them, they
+// register in the order of the list, so routes of tests don't depend on
+// scheduling. Returned function kills all actors and waits until they stop
 func (f forEach) Run() func() {
-	var wg sync.WaitGroup
+	specs := make([]sandbox.ChildSpec, 0, len(f))
+	var prev sandbox.Actor
 	for i := 0; i < len(f); i++ {
-		wg.Add(1)
-		a := f[i]
-		go func() {
-			defer func() {
-				wg.Done()
-			}()
-			a.Run()
-		}()
+		a, after := f[i], prev
+		specs = append(specs, sandbox.ChildSpec{
+			ID: a.GetMeta().ID,
+			Start: func() sandbox.Child {
+				if after != nil {
+					select {
+					case <-after.IsRegistered():
+					case <-after.Liveness():
+					}
+				}
+				return a
+			},
+			Restart: sandbox.Temporary,
+		})
+		prev = a
 	}
+
+	return runSupervisor(sandbox.NewSupervisor("test", sandbox.SupervisorPolicy{}, specs...))
+}
+
+func runSupervisor(sup sandbox.Supervisor) func() {
+	joinCh := make(chan struct{})
+	go func() {
+		sup.Run()
+		close(joinCh)
+	}()
 	return func() {
-		f.Kill()
-		wg.Wait()
+		sup.Kill()
+		<-joinCh
 	}
 }
 
@@ -53,13 +79,9 @@ func (f forEach) WaitRegistered() {
 	logrus.Info("all actors successfully registered")
 }
 
-func (f forEach) CheckNetworkConnectivity() bool {
-	for i := 0; i < len(f); i++ {
-		if !f[i].IsAlive() && f[i].GetMeta().NetworkHolder {
-			return false
-		}
-	}
-	return true
+// CheckNetworkConnectivity probes the connection from the first actor
+func (f forEach) CheckNetworkConnectivity(router sandbox.Router, connID string) bool {
+	return sandbox.Probe(router, f[0], connID).Delivered
 }
 
 func (f forEach) Kill() {
@@ -71,62 +93,104 @@ func (f forEach) Kill() {
 }
 
 func (f forEach) WaitClosed(ctx context.Context, connId string) error {
+	return f.WatchClosed(connId)(ctx)
+}
+
+// WatchClosed subscribes to monitors immediately, so the returned
+// function doesn't miss Delete events that happen before it is called
+func (f forEach) WatchClosed(connId string) func(ctx context.Context) error {
 	readyCh := make(chan struct{}, len(f))
+	stopCh := make(chan struct{})
 
 	for i := 0; i < len(f); i++ {
 		a := f[i]
+		monitor := a.Monitor()
 		go func() {
-			monitor := a.Monitor()
-			for event := range monitor {
-				if event.EventType != sandbox.Delete {
-					continue
-				}
+			defer a.Unsubscribe(monitor)
 
-				for _, c := range event.Connections {
-					if c.ID == connId {
-						readyCh <- struct{}{}
-						return
+			for {
+				select {
+				case <-stopCh:
+					return
+				case event := <-monitor:
+					if event.EventType != sandbox.Delete {
+						continue
+					}
+
+					for _, c := range event.Connections {
+						if c.ID == connId {
+							readyCh <- struct{}{}
+							return
+						}
 					}
 				}
 			}
 		}()
 	}
 
-	for i := 0; i < len(f); i++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-readyCh:
-			continue
+	var once sync.Once
+	return func(ctx context.Context) error {
+		// watchers that haven't seen the Delete event are stopped
+		defer once.Do(func() { close(stopCh) })
+
+		for i := 0; i < len(f); i++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-readyCh:
+				continue
+			}
 		}
+		return nil
 	}
-
-	return nil
 }
 
-func (f forEach) WaitConnectionState(connID string, state sandbox.HealState) {
+// waitStateTimeout is how long WaitConnectionState waits before it fails the test
+const waitStateTimeout = 10 * time.Second
+
+func (f forEach) WaitConnectionState(t *testing.T, connID string, state sandbox.HealState) {
 	var wg sync.WaitGroup
+	doneCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
 	for i := 0; i < len(f); i++ {
 		a := f[i]
+		monitor := a.Monitor()
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer a.Unsubscribe(monitor)
 
-			monitor := a.Monitor()
-			for event := range monitor {
-				if event.EventType == sandbox.Delete {
-					continue
-				}
+			for {
+				select {
+				case <-stopCh:
+					return
+				case event := <-monitor:
+					if event.EventType == sandbox.Delete {
+						continue
+					}
 
-				for _, c := range event.Connections {
-					if c.ID == connID && c.State == state {
-						return
+					for _, c := range event.Connections {
+						if c.ID == connID && c.State == state {
+							return
+						}
 					}
 				}
 			}
 		}()
 	}
+
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(waitStateTimeout):
+		t.Fatalf("%s doesn't reach the %v state within %v", connID, state, waitStateTimeout)
+	}
 }
 
 func (f forEach) FindByID(id string) sandbox.Actor {
@@ -139,55 +203,92 @@ func (f forEach) FindByID(id string) sandbox.Actor {
 }
 
 func (f forEach) PrintState() {
-	fmt.Println()
-	for i := 0; i < len(f); i++ {
-		f[i].PrintState()
-		fmt.Println()
-	}
+	_ = sandbox.Snapshot(f...).WriteTable(os.Stdout)
 }
 
 func actorsChain(router sandbox.Router, meta ...sandbox.Meta) []sandbox.Actor {
+	return actorsChainWith(router, nil, meta...)
+}
+
+func actorsChainWith(router sandbox.Router, opts []sandbox.Option, meta ...sandbox.Meta) []sandbox.Actor {
 	actors := make([]sandbox.Actor, 0, len(meta))
 
 	for _, m := range meta {
-		actors = append(actors, sandbox.NewActor(m, router))
+		actors = append(actors, sandbox.NewActor(m, router, opts...))
 	}
 
 	return actors
 }
 
 func newNSC(id, node string) sandbox.Meta {
-	return sandbox.Meta{
-		ID:            id,
-		Node:          node,
-		Class:         "nsc",
-		NetworkHolder: true,
-	}
+	return topology.NewNSC(id, node)
 }
 
 func newNSE(id, node string) sandbox.Meta {
-	return sandbox.Meta{
-		ID:            id,
-		Node:          node,
-		Class:         "nse",
-		NetworkHolder: true,
-	}
+	return topology.NewNSE(id, node)
 }
 
 func newNSMgr(node string) sandbox.Meta {
-	return sandbox.Meta{
-		ID:            fmt.Sprintf("nsmgr-%s", node),
-		Node:          node,
-		Class:         "nsmgr",
-		NetworkHolder: false,
-	}
+	return topology.NewNSMgr(node)
 }
 
 func newForwarder(id, node string) sandbox.Meta {
-	return sandbox.Meta{
-		ID:            id,
-		Node:          node,
-		Class:         "forwarder",
-		NetworkHolder: true,
+	return topology.NewForwarder(id, node)
+}
+
+// hopsOf returns hops of the connection from the state of the actor,
+// it's nil if the actor doesn't have the connection
+func hopsOf(a sandbox.Actor, connID string) func() []string {
+	return func() []string {
+		conn, _ := a.State().Connection(connID)
+		return conn.Hops
+	}
+}
+
+// printLogsOnFailure prints entries of given actors, or all of them,
+// if the test has failed, it is supposed to be deferred
+func printLogsOnFailure(t *testing.T, logs sandbox.CaptureLogger, actorIDs ...string) {
+	if !t.Failed() {
+		return
+	}
+	var sb strings.Builder
+	_ = logs.WriteTo(&sb, actorIDs...)
+	t.Logf("logs of %v:\n%s", actorIDs, sb.String())
+}
+
+// writeTimeline writes the Chrome trace of the test to $TIMELINE_DIR/<test>.json,
+// open it in chrome://tracing or ui.perfetto.dev, it is supposed to be deferred
+func writeTimeline(t *testing.T, recorder sandbox.Recorder) {
+	dir := os.Getenv("TIMELINE_DIR")
+	if dir == "" {
+		return
+	}
+	path := filepath.Join(dir, strings.Replace(t.Name(), "/", "_", -1)+".json")
+	if err := sandbox.WriteChromeTraceFile(recorder, path); err != nil {
+		t.Logf("failed to write the timeline: %v", err)
+		return
+	}
+	t.Logf("timeline is written to %s", path)
+}
+
+// checkInvariants evaluates invariants, or the default ones, on events of actors
+// until the returned function is called, the function fails the test with every
+// violation and its history and is supposed to be deferred before actors are killed
+func checkInvariants(t *testing.T, actors []sandbox.Actor, invariants ...sandbox.Invariant) func() {
+	if len(invariants) == 0 {
+		invariants = sandbox.DefaultInvariants()
+	}
+	checker := sandbox.NewInvariantChecker(invariants...)
+	stopCh := make(chan struct{})
+	for _, a := range actors {
+		checker.Watch(a, stopCh)
+	}
+
+	return func() {
+		checker.Check()
+		close(stopCh)
+		for _, v := range checker.Violations() {
+			t.Error(v.String())
+		}
 	}
 }
@@ -0,0 +1,227 @@
+package topology
+
+import (
+	"fmt"
+	"github.com/lobkovilya/healsandbox/sandbox"
+)
+
+const (
+	NSCClass       = "nsc"
+	NSMgrClass     = "nsmgr"
+	ForwarderClass = "forwarder"
+	NSEClass       = "nse"
+)
+
+// RoutePolicy plans routes of this topology with Router.PlanRoute
+var RoutePolicy = sandbox.NodeLocalPolicy{
+	Classes: []string{NSMgrClass, ForwarderClass},
+}
+
+type Node struct {
+	Name       string
+	NSMgr      sandbox.Meta
+	Forwarders []sandbox.Meta
+	NSCs       []sandbox.Meta
+	NSEs       []sandbox.Meta
+}
+
+// Topology describes the mesh, every node has an nsmgr and forwarders,
+// clients and endpoints are spread across nodes
+type Topology struct {
+	Nodes []Node
+}
+
+type Builder struct {
+	nodes      int
+	forwarders int
+	nscs       int
+	nses       int
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		nodes:      1,
+		forwarders: 1,
+	}
+}
+
+// Nodes sets the number of nodes, clients and endpoints
+// need at least one, so it panics if n < 1
+func (b *Builder) Nodes(n int) *Builder {
+	if n < 1 {
+		panic(fmt.Sprintf("topology needs at least one node, got %d", n))
+	}
+	b.nodes = n
+	return b
+}
+
+// Forwarders sets the number of forwarders per node
+func (b *Builder) Forwarders(n int) *Builder {
+	b.forwarders = n
+	return b
+}
+
+// NSCs sets the total number of clients, they are placed round-robin
+func (b *Builder) NSCs(n int) *Builder {
+	b.nscs = n
+	return b
+}
+
+// NSEs sets the total number of endpoints, they are placed round-robin
+func (b *Builder) NSEs(n int) *Builder {
+	b.nses = n
+	return b
+}
+
+func (b *Builder) Build() *Topology {
+	t := &Topology{}
+	for i := 1; i <= b.nodes; i++ {
+		name := fmt.Sprintf("node-%d", i)
+		node := Node{
+			Name:  name,
+			NSMgr: NewNSMgr(name),
+		}
+		for j := 1; j <= b.forwarders; j++ {
+			node.Forwarders = append(node.Forwarders, NewForwarder(fmt.Sprintf("fw-%s-%d", name, j), name))
+		}
+		t.Nodes = append(t.Nodes, node)
+	}
+
+	for i := 0; i < b.nscs; i++ {
+		node := &t.Nodes[i%b.nodes]
+		node.NSCs = append(node.NSCs, NewNSC(fmt.Sprintf("nsc-%d", i+1), node.Name))
+	}
+	for i := 0; i < b.nses; i++ {
+		node := &t.Nodes[i%b.nodes]
+		node.NSEs = append(node.NSEs, NewNSE(fmt.Sprintf("icmp-responder-%d", i+1), node.Name))
+	}
+	return t
+}
+
+// Metas returns all actors: clients first, then nsmgr and forwarders
+// node by node and endpoints in the end, so killing them in this
+// order goes along the route
+func (t *Topology) Metas() []sandbox.Meta {
+	rv := []sandbox.Meta{}
+	for _, n := range t.Nodes {
+		rv = append(rv, n.NSCs...)
+	}
+	for _, n := range t.Nodes {
+		rv = append(rv, n.NSMgr)
+		rv = append(rv, n.Forwarders...)
+	}
+	for _, n := range t.Nodes {
+		rv = append(rv, n.NSEs...)
+	}
+	return rv
+}
+
+func (t *Topology) Meta(id string) (sandbox.Meta, bool) {
+	for _, m := range t.Metas() {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return sandbox.Meta{}, false
+}
+
+func (t *Topology) Node(name string) (Node, bool) {
+	for _, n := range t.Nodes {
+		if n.Name == name {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+// Route returns hops from the client to the endpoint, the route crosses
+// nodes through both nsmgrs and forwarders:
+// nsc → nsmgr → forwarder → nsmgr → forwarder → nse
+func (t *Topology) Route(nscID, nseID string) ([]string, error) {
+	nsc, nse, err := t.ends(nscID, nseID)
+	if err != nil {
+		return nil, err
+	}
+
+	route := []string{
+		sandbox.Hop(NSCClass, nsc.Node),
+		sandbox.Hop(NSMgrClass, nsc.Node),
+		sandbox.Hop(ForwarderClass, nsc.Node),
+	}
+	if nsc.Node != nse.Node {
+		route = append(route,
+			sandbox.Hop(NSMgrClass, nse.Node),
+			sandbox.Hop(ForwarderClass, nse.Node))
+	}
+	return append(route, sandbox.Hop(NSEClass, nse.Node)), nil
+}
+
+// Path returns IDs of actors the Route is expected to pass
+// when the first forwarder on every node is chosen
+func (t *Topology) Path(nscID, nseID string) ([]string, error) {
+	nsc, nse, err := t.ends(nscID, nseID)
+	if err != nil {
+		return nil, err
+	}
+
+	src, _ := t.Node(nsc.Node)
+	path := []string{nsc.ID, src.NSMgr.ID, src.Forwarders[0].ID}
+	if nsc.Node != nse.Node {
+		dst, _ := t.Node(nse.Node)
+		path = append(path, dst.NSMgr.ID, dst.Forwarders[0].ID)
+	}
+	return append(path, nse.ID), nil
+}
+
+func (t *Topology) ends(nscID, nseID string) (nsc, nse sandbox.Meta, err error) {
+	nsc, ok := t.Meta(nscID)
+	if !ok || nsc.Class != NSCClass {
+		return nsc, nse, fmt.Errorf("no client with id '%s'", nscID)
+	}
+	nse, ok = t.Meta(nseID)
+	if !ok || nse.Class != NSEClass {
+		return nsc, nse, fmt.Errorf("no endpoint with id '%s'", nseID)
+	}
+	for _, id := range []string{nsc.Node, nse.Node} {
+		if n, _ := t.Node(id); len(n.Forwarders) == 0 {
+			return nsc, nse, fmt.Errorf("no forwarders on node '%s'", id)
+		}
+	}
+	return nsc, nse, nil
+}
+
+func NewNSC(id, node string) sandbox.Meta {
+	return sandbox.Meta{
+		ID:            id,
+		Node:          node,
+		Class:         NSCClass,
+		NetworkHolder: true,
+	}
+}
+
+func NewNSE(id, node string) sandbox.Meta {
+	return sandbox.Meta{
+		ID:            id,
+		Node:          node,
+		Class:         NSEClass,
+		NetworkHolder: true,
+	}
+}
+
+func NewNSMgr(node string) sandbox.Meta {
+	return sandbox.Meta{
+		ID:            fmt.Sprintf("nsmgr-%s", node),
+		Node:          node,
+		Class:         NSMgrClass,
+		NetworkHolder: false,
+	}
+}
+
+func NewForwarder(id, node string) sandbox.Meta {
+	return sandbox.Meta{
+		ID:            id,
+		Node:          node,
+		Class:         ForwarderClass,
+		NetworkHolder: true,
+	}
+}